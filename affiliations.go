@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+
+	"github.com/jinzhu/gorm"
+)
+
+var countryCodeRe = regexp.MustCompile(`^[A-Z]{3}$`)
+
+// Get team affiliation from mysql db by short name
+func GetAffiliationByShortName(shortName string, db *gorm.DB) (affiliation TeamAffiliation, err error) {
+	var affiliations []TeamAffiliation
+	if err = db.Table("team_affiliation").Limit(1).Where("shortname = ?", shortName).Find(&affiliations).Error; err != nil {
+		return affiliation, PrintErr("READ_AFFILIATION_BY_SHORTNAME_ERR", fmt.Sprintf("(shortname %s): %v", shortName, err))
+	}
+	if len(affiliations) > 0 {
+		return affiliations[0], nil
+	}
+	return affiliation, nil
+}
+
+// Create a new team affiliation in team_affiliation table (affilid is auto incremented by mysql)
+// Country, if present, must be an ISO 3166-1 alpha-3 code like IND or USA
+func CreateAffiliation(shortName string, name string, country string, db *gorm.DB) (affiliation TeamAffiliation, err error) {
+	if country != "" && !countryCodeRe.MatchString(country) {
+		return affiliation, PrintErr("AFFILIATION_COUNTRY_ERR", fmt.Sprintf("country %s is not an ISO 3166-1 alpha-3 code", country))
+	}
+	curAffiliation, err := GetAffiliationByShortName(shortName, db)
+	if err != nil {
+		return affiliation, err
+	}
+	if curAffiliation.AffilId > 0 {
+		log.Printf("AFFILIATION_ALREADY_PRESENT: (shortname: %s, name: %s)\n", shortName, curAffiliation.Name)
+		return curAffiliation, nil
+	}
+
+	if name == "" {
+		name = shortName
+	}
+	externalId := shortName
+	affiliation = TeamAffiliation{
+		ExternalId: &externalId,
+		ShortName:  shortName,
+		Name:       name,
+	}
+	if country != "" {
+		affiliation.Country = &country
+	}
+	PrintVal("NEW_AFFILIATION", affiliation)
+	if err = db.Table("team_affiliation").Create(&affiliation).Error; err != nil {
+		return affiliation, PrintErr("INSERT_AFFILIATION_TABLE_ERR", fmt.Sprintf("Error inserting %s into 'team_affiliation' table: %v", shortName, err))
+	}
+	return affiliation, nil
+}
+
+// Print all team affiliations with the number of teams linked to each of them
+func ListAffiliations(config *Config) (err error) {
+	sqlQuery := `SELECT a.affilid, a.shortname, a.name, COALESCE(a.country, ''), COUNT(t.teamid)
+		FROM team_affiliation a LEFT JOIN team t ON t.affilid = a.affilid
+		GROUP BY a.affilid, a.shortname, a.name, a.country ORDER BY a.shortname`
+	rows, err := config.Db.Raw(sqlQuery).Rows()
+	if err != nil {
+		return PrintErr("READ_AFFILIATIONS_ERR", fmt.Sprintf("%v", err))
+	}
+	defer rows.Close()
+
+	fmt.Printf("affilid\tshortname\tname\tcountry\tteams\n")
+	for rows.Next() {
+		var affiliation TeamAffiliation
+		var country string
+		var teams int
+		if err = rows.Scan(&affiliation.AffilId, &affiliation.ShortName, &affiliation.Name, &country, &teams); err != nil {
+			return PrintErr("FETCH_AFFILIATION_ERR", fmt.Sprintf("%v", err))
+		}
+		fmt.Printf("%d\t%s\t%s\t%s\t%d\n", affiliation.AffilId, affiliation.ShortName, affiliation.Name, country, teams)
+	}
+	return nil
+}
+
+// Delete a team affiliation by short name, teams linked to it are kept but unlinked
+func DeleteAffiliation(shortName string, config *Config) (err error) {
+	affiliation, err := GetAffiliationByShortName(shortName, config.Db)
+	if err != nil {
+		return err
+	}
+	if affiliation.AffilId == 0 {
+		return PrintErr("AFFILIATION_NOT_FOUND_TO_DELETE", fmt.Sprintf("No affiliation found for %s", shortName))
+	}
+	PrintVal("AFFILIATION_TO_DELETE", affiliation)
+
+	tx := config.Db.Begin()
+	if err = tx.Error; err != nil {
+		return PrintErr("TXN_OBJ_ERR", fmt.Sprintf("%v", err))
+	}
+	res := tx.Table("team").Where("affilid = ?", affiliation.AffilId).Update("affilid", gorm.Expr("NULL"))
+	if err = res.Error; err != nil {
+		tx.Rollback()
+		return PrintErr("UNLINK_AFFILIATION_TEAMS_ERR", fmt.Sprintf("(shortname %s): %v", shortName, err))
+	}
+	log.Printf("UNLINK_AFFILIATION_TEAMS_SUCCESS: (shortname: %s, teams: %d)\n", shortName, res.RowsAffected)
+	if err = tx.Table("team_affiliation").Delete(TeamAffiliation{}, "affilid = ?", affiliation.AffilId).Error; err != nil {
+		tx.Rollback()
+		return PrintErr("DELETE_FROM_AFFILIATION_TABLE_ERR", fmt.Sprintf("Error deleting %s from 'team_affiliation' table: %v", shortName, err))
+	}
+	if err = tx.Commit().Error; err != nil {
+		return PrintErr("TX_COMMIT_ERR", fmt.Sprintf("Error deleting affiliation %s as txn: %v", shortName, err))
+	}
+	return nil
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/user"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Name of audit table in DOMJudge database (DOMJudge's own auditlog table is left alone)
+const auditTable = "domjudge_interview_audit"
+
+// One successful mutation done by this service, written as a JSON line to audit-file
+type AuditEntry struct {
+	Time     time.Time `json:"time"`
+	Operator string    `json:"operator"`
+	Op       string    `json:"op"`
+	Action   string    `json:"action"`
+	Contest  string    `json:"contest"`
+	Cid      int       `json:"cid"`
+	TeamIds  []int     `json:"teamids,omitempty"`
+	UserIds  []int     `json:"userids,omitempty"`
+	Emails   []string  `json:"emails,omitempty"`
+}
+
+// Row of audit table, the full entry is kept as JSON next to the columns used to query it
+type AuditRow struct {
+	Id       int       `gorm:"column:id;PRIMARY_KEY;"`
+	Time     time.Time `gorm:"column:time;"`
+	Operator string    `gorm:"column:operator;"`
+	Action   string    `gorm:"column:action;"`
+	Contest  string    `gorm:"column:contest;"`
+	Emails   string    `gorm:"column:emails;"`
+	Entry    string    `gorm:"column:entry;"`
+}
+
+// Appends audit entries to audit-file and, if audit-table is set, to the audit table
+// In dry run mode entries only go to the plan
+type AuditLog struct {
+	mutex    sync.Mutex
+	filename string
+	db       *gorm.DB
+	operator string
+	op       string
+	plan     *DryRunPlan
+}
+
+// Create audit log for this run, creating the audit table if needed
+func NewAuditLog(cliArgs *CliArgs, db *gorm.DB, plan *DryRunPlan) (audit *AuditLog, err error) {
+	audit = &AuditLog{filename: cliArgs.AuditFile, operator: cliArgs.Operator, op: cliArgs.Op, plan: plan}
+	if cliArgs.AuditTable {
+		audit.db = db
+		if plan == nil {
+			sqlQuery := `CREATE TABLE IF NOT EXISTS ` + auditTable + ` (
+				id int(4) unsigned NOT NULL AUTO_INCREMENT,
+				time datetime NOT NULL,
+				operator varchar(255) NOT NULL,
+				action varchar(32) NOT NULL,
+				contest varchar(255) NOT NULL,
+				emails text NOT NULL,
+				entry text NOT NULL,
+				PRIMARY KEY (id), KEY contest (contest)
+			) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`
+			if err = db.Exec(sqlQuery).Error; err != nil {
+				return nil, PrintErr("CREATE_AUDIT_TABLE_ERR", fmt.Sprintf("%v", err))
+			}
+		}
+	}
+	return audit, nil
+}
+
+// Operator recorded in audit entries if operator arg is not given: $USER or the login name of this process
+func DefaultOperator() string {
+	if name := os.Getenv("USER"); name != "" {
+		return name
+	}
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return "unknown"
+}
+
+// Record a successful mutation, failures are logged but do not fail the (already committed) mutation
+func (a *AuditLog) Record(entry AuditEntry) {
+	if a == nil {
+		return
+	}
+	entry.Time = time.Now().UTC()
+	entry.Operator = a.operator
+	entry.Op = a.op
+	line, _ := json.Marshal(entry)
+	if a.plan != nil {
+		a.plan.Add("AUDIT", string(line))
+		return
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.filename != "" {
+		file, err := os.OpenFile(a.filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			log.Printf("AUDIT_FILE_ERR: failed to open %s (%s): %v\n", a.filename, line, err)
+		} else {
+			if _, err = file.Write(append(line, '\n')); err != nil {
+				log.Printf("AUDIT_FILE_ERR: failed to write %s (%s): %v\n", a.filename, line, err)
+			}
+			file.Close()
+		}
+	}
+	if a.db != nil {
+		row := AuditRow{
+			Time:     entry.Time,
+			Operator: entry.Operator,
+			Action:   entry.Action,
+			Contest:  entry.Contest,
+			Emails:   strings.Join(entry.Emails, ","),
+			Entry:    string(line),
+		}
+		if err := a.db.Table(auditTable).Create(&row).Error; err != nil {
+			log.Printf("AUDIT_TABLE_ERR: failed to insert (%s): %v\n", line, err)
+		}
+	}
+}
+
+// Read audit entries of a contest and/or email (empty matches all) from audit table if audit-table is set,
+// from audit-file otherwise
+func ReadAuditEntries(contestShortName string, email string, config *Config) (entries []AuditEntry, err error) {
+	var lines []string
+	if config.CliArgs.AuditTable {
+		query := config.Db.Table(auditTable).Order("id")
+		if contestShortName != "" {
+			query = query.Where("contest = ?", contestShortName)
+		}
+		if email != "" {
+			query = query.Where("FIND_IN_SET(?, emails) > 0", email)
+		}
+		var rows []AuditRow
+		if err = query.Find(&rows).Error; err != nil {
+			return nil, PrintErr("READ_AUDIT_TABLE_ERR", fmt.Sprintf("%v", err))
+		}
+		for _, row := range rows {
+			lines = append(lines, row.Entry)
+		}
+	} else {
+		file, err := os.Open(config.CliArgs.AuditFile)
+		if err != nil {
+			return nil, PrintErr("AUDIT_FILE_OPEN_ERR", fmt.Sprintf("%v", err))
+		}
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for scanner.Scan() {
+			if line := strings.TrimSpace(scanner.Text()); line != "" {
+				lines = append(lines, line)
+			}
+		}
+		if err = scanner.Err(); err != nil {
+			return nil, PrintErr("AUDIT_FILE_READ_ERR", fmt.Sprintf("%v", err))
+		}
+	}
+
+	for i, line := range lines {
+		var entry AuditEntry
+		if err = json.Unmarshal([]byte(line), &entry); err != nil {
+			return nil, PrintErr("AUDIT_ENTRY_PARSE_ERR", fmt.Sprintf("entry %d (%s): %v", i+1, line, err))
+		}
+		if contestShortName != "" && entry.Contest != contestShortName {
+			continue
+		}
+		if email != "" && !containsString(entry.Emails, email) {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// Print audit entries of a contest and/or email as TSV to stdout
+func ShowAudit(contestShortName string, email string, config *Config) (err error) {
+	entries, err := ReadAuditEntries(contestShortName, email, config)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("time\toperator\top\taction\tcontest\tcid\tteamids\tuserids\temails\n")
+	for _, entry := range entries {
+		fmt.Printf("%s\t%s\t%s\t%s\t%s\t%d\t%s\t%s\t%s\n", entry.Time.Format(time.RFC3339), entry.Operator, entry.Op, entry.Action,
+			entry.Contest, entry.Cid, joinInts(entry.TeamIds), joinInts(entry.UserIds), strings.Join(entry.Emails, ","))
+	}
+	log.Printf("SHOW_AUDIT: %d entries (contest: %s, email: %s)\n", len(entries), contestShortName, email)
+	return nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func joinInts(values []int) string {
+	strs := make([]string, len(values))
+	for i, v := range values {
+		strs[i] = fmt.Sprintf("%d", v)
+	}
+	return strings.Join(strs, ",")
+}
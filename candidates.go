@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	"log"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Formats supported for report-file of CANDIDATE_REPORT
+var candidateReportFormats = map[string]bool{"markdown": true, "html": true}
+
+// Test case a judging run of a submission did not pass
+type FailedTestCase struct {
+	Rank        int     `json:"rank"`
+	Description string  `json:"description"`
+	Sample      bool    `json:"sample"`
+	Result      string  `json:"result"`
+	Runtime     float64 `json:"runtime"`
+}
+
+// Submission of a candidate with the test cases its latest valid judging failed
+type CandidateSubmission struct {
+	SubmissionExport
+	Failed []FailedTestCase `json:"failed"`
+}
+
+// Score of a candidate for a problem with the source of the last correct submission (Accepted is nil if unsolved)
+type CandidateProblem struct {
+	ProblemScore
+	Accepted *SubmissionExport `json:"accepted"`
+	Source   string            `json:"source"`
+}
+
+// Everything an interviewer needs about one candidate in one contest
+type CandidateReport struct {
+	Contest     Contest               `json:"contest"`
+	GeneratedAt time.Time             `json:"generated_at"`
+	User        *User                 `json:"user"`
+	Rank        int                   `json:"rank"`
+	Candidates  int                   `json:"candidates"`
+	Points      int                   `json:"points"`
+	TotalTime   int64                 `json:"totaltime"`
+	Languages   []string              `json:"languages"`
+	Submissions []CandidateSubmission `json:"submissions"`
+	Problems    []CandidateProblem    `json:"problems"`
+}
+
+// Build the report of the candidate with email in a contest and write it to reportFile as markdown or html:
+// rank and score, timeline of every submission (minute from contest start, problem, language, verdict and failed
+// test cases) and the source of the last correct submission of every problem
+func WriteCandidateReport(contestShortName string, email string, format string, reportFile string, config *Config) (err error) {
+	report, err := BuildCandidateReport(contestShortName, email, config)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	switch format {
+	case "markdown":
+		err = writeCandidateMarkdown(&buf, report)
+	case "html":
+		err = candidateHtmlTemplate.Execute(&buf, report)
+	}
+	if err != nil {
+		return PrintErr("CANDIDATE_REPORT_RENDER_ERR", fmt.Sprintf("failed to render %s report of %s: %v", format, email, err))
+	}
+	if err = writeExportFile(reportFile, buf.Bytes(), config); err != nil {
+		return err
+	}
+	log.Printf("CANDIDATE_REPORT_SUCCESS: (contestshortname: %s, email: %s, submissions: %d, file: %s)\n", contestShortName, email, len(report.Submissions), reportFile)
+	return nil
+}
+
+// Collect the report of the candidate with email in a contest from submissions, judgings, scorecache and rankcache
+func BuildCandidateReport(contestShortName string, email string, config *Config) (report *CandidateReport, err error) {
+	user, err := GetUserById("email", email, false, config.Db)
+	if err != nil {
+		return nil, err
+	}
+	contest, submissions, files, err := FetchContestSubmissions(contestShortName, config)
+	if err != nil {
+		return nil, err
+	}
+	count := 0
+	if err = config.Db.Table("contestteam").Where("cid = ? AND teamid = ?", contest.Cid, user.TeamId).Count(&count).Error; err != nil {
+		return nil, PrintErr("READ_CONTESTTEAM_ERR", fmt.Sprintf("(email: %s, contestshortname: %s): %v", email, contestShortName, err))
+	}
+	if count == 0 {
+		return nil, PrintErr("CANDIDATE_NOT_IN_CONTEST", fmt.Sprintf("(email: %s, contestshortname: %s)", email, contestShortName))
+	}
+
+	// 1. Rank and score, candidates without a rankcache row (no submissions yet) are unranked
+	users, teamScores, problems, err := FetchResults(contestShortName, config)
+	if err != nil {
+		return nil, err
+	}
+	report = &CandidateReport{Contest: contest, GeneratedAt: time.Now(), User: user, Candidates: len(users)}
+	scores := make([]ProblemScore, len(problems))
+	for i, problem := range problems {
+		scores[i] = ProblemScore{ShortName: problem.ShortName, ProbId: problem.ProbId}
+	}
+	for i := range users {
+		if users[i].UserId == user.UserId {
+			report.Rank, report.Points, report.TotalTime = i+1, teamScores[i].Points, teamScores[i].TimeTaken
+			scores = teamScores[i].Problems
+		}
+	}
+
+	// 2. Timeline of submissions and languages used
+	languages := make(map[string]bool)
+	var judgingIds []int
+	for _, submission := range submissions {
+		if submission.TeamId != user.TeamId {
+			continue
+		}
+		report.Submissions = append(report.Submissions, CandidateSubmission{SubmissionExport: submission})
+		if !languages[submission.LangId] {
+			languages[submission.LangId] = true
+			report.Languages = append(report.Languages, submission.LangId)
+		}
+		if submission.JudgingId != 0 {
+			judgingIds = append(judgingIds, submission.JudgingId)
+		}
+	}
+	sort.Strings(report.Languages)
+
+	// 3. Failed test cases of latest judgings
+	failed, err := fetchFailedTestCases(judgingIds, config)
+	if err != nil {
+		return nil, err
+	}
+	for i := range report.Submissions {
+		report.Submissions[i].Failed = failed[report.Submissions[i].JudgingId]
+	}
+
+	// 4. Last correct submission of every problem
+	for _, score := range scores {
+		problem := CandidateProblem{ProblemScore: score}
+		for i := range report.Submissions {
+			submission := report.Submissions[i].SubmissionExport
+			if submission.ProbId == score.ProbId && submission.Verdict == "correct" {
+				submission.Files = nil
+				for _, file := range files[submission.SubmitId] {
+					submission.Files = append(submission.Files, file.Filename)
+				}
+				problem.Accepted = &submission
+				problem.Source = submissionSource(files[submission.SubmitId])
+			}
+		}
+		report.Problems = append(report.Problems, problem)
+	}
+	return report, nil
+}
+
+// Test cases not passed by judging runs of judgings (judgingid -> failed test cases in test case order)
+func fetchFailedTestCases(judgingIds []int, config *Config) (failed map[int][]FailedTestCase, err error) {
+	failed = make(map[int][]FailedTestCase)
+	if len(judgingIds) == 0 {
+		return failed, nil
+	}
+	sqlQuery := `SELECT r.judgingid, t.rank, t.description, t.sample, r.runresult, r.runtime FROM judging_run r
+		JOIN testcase t ON t.testcaseid = r.testcaseid WHERE r.judgingid IN (?) AND r.runresult <> 'correct' ORDER BY r.judgingid, t.rank`
+	rows, err := config.Db.Raw(sqlQuery, judgingIds).Rows()
+	if err != nil {
+		return nil, PrintErr("READ_JUDGING_RUNS_ERR", fmt.Sprintf("judgingids: %s: %v", joinInts(judgingIds), err))
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var judgingId int
+		var testCase FailedTestCase
+		var description *string
+		var runtime *float64
+		if err = rows.Scan(&judgingId, &testCase.Rank, &description, &testCase.Sample, &testCase.Result, &runtime); err != nil {
+			return nil, PrintErr("FETCH_JUDGING_RUN_ERR", fmt.Sprintf("judgingid: %d: %v", judgingId, err))
+		}
+		if description != nil {
+			testCase.Description = *description
+		}
+		if runtime != nil {
+			testCase.Runtime = *runtime
+		}
+		failed[judgingId] = append(failed[judgingId], testCase)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, PrintErr("FETCH_JUDGING_RUN_ERR", fmt.Sprintf("judgingids: %s: %v", joinInts(judgingIds), err))
+	}
+	return failed, nil
+}
+
+// Short text of the failed test cases of a submission, e.g. "#2 wrong-answer (sample), #5 timelimit"
+func failedTestCasesText(failed []FailedTestCase) string {
+	var parts []string
+	for _, testCase := range failed {
+		part := fmt.Sprintf("#%d %s", testCase.Rank, testCase.Result)
+		if testCase.Sample {
+			part += " (sample)"
+		}
+		parts = append(parts, part)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Write the report as markdown, sources go in fenced blocks longer than any backtick run inside them
+func writeCandidateMarkdown(buf *bytes.Buffer, report *CandidateReport) (err error) {
+	escape := strings.NewReplacer("|", "\\|", "\n", " ")
+	fmt.Fprintf(buf, "# %s\n\n", escape.Replace(report.User.Email))
+	fmt.Fprintf(buf, "* Contest: %s (%s)\n", escape.Replace(report.Contest.Name), escape.Replace(report.Contest.ShortName))
+	fmt.Fprintf(buf, "* Username: %s\n", escape.Replace(report.User.Username))
+	if report.Rank > 0 {
+		fmt.Fprintf(buf, "* Rank: %d of %d\n", report.Rank, report.Candidates)
+	} else {
+		fmt.Fprintf(buf, "* Rank: unranked\n")
+	}
+	fmt.Fprintf(buf, "* Points: %d, total time: %d\n", report.Points, report.TotalTime)
+	fmt.Fprintf(buf, "* Languages: %s\n", strings.Join(report.Languages, ", "))
+	fmt.Fprintf(buf, "* Generated: %s\n\n", report.GeneratedAt.Format("2006-01-02 15:04"))
+
+	buf.WriteString("## Problems\n\n| problem | result |\n|---|:---:|\n")
+	for _, problem := range report.Problems {
+		fmt.Fprintf(buf, "| %s | %s |\n", escape.Replace(problem.ShortName), problemScoreCell(problem.ProblemScore))
+	}
+
+	buf.WriteString("\n## Timeline\n\n| minute | submitted | problem | language | verdict | failed test cases |\n|---:|---|---|---|---|---|\n")
+	for _, submission := range report.Submissions {
+		fmt.Fprintf(buf, "| %d | %s | %s | %s | %s | %s |\n", submission.ContestTime, submission.SubmitTime, escape.Replace(submission.Problem),
+			escape.Replace(submission.LangId), escape.Replace(submission.Verdict), escape.Replace(failedTestCasesText(submission.Failed)))
+	}
+	if len(report.Submissions) == 0 {
+		buf.WriteString("\nNo submissions.\n")
+	}
+
+	buf.WriteString("\n## Accepted sources\n")
+	for _, problem := range report.Problems {
+		fmt.Fprintf(buf, "\n### %s\n\n", escape.Replace(problem.ShortName))
+		if problem.Accepted == nil {
+			buf.WriteString("Not solved.\n")
+			continue
+		}
+		fmt.Fprintf(buf, "Submission %d at minute %d in %s:\n\n", problem.Accepted.SubmitId, problem.Accepted.ContestTime, escape.Replace(problem.Accepted.LangId))
+		fence := "```"
+		for strings.Contains(problem.Source, fence) {
+			fence += "`"
+		}
+		fmt.Fprintf(buf, "%s%s\n%s\n%s\n", fence, markdownLanguage(problem.Accepted), strings.TrimRight(problem.Source, "\n"), fence)
+	}
+	return nil
+}
+
+// Language of a fenced code block from the extension of the submitted file (DOMJudge langids are extensions too)
+func markdownLanguage(submission *SubmissionExport) string {
+	ext := submission.LangId
+	if len(submission.Files) == 0 {
+		return ext
+	}
+	if fileExt := strings.TrimPrefix(path.Ext(submission.Files[0]), "."); fileExt != "" {
+		ext = fileExt
+	}
+	return ext
+}
+
+// Self-contained HTML report (no external CSS or scripts)
+var candidateHtmlTemplate = htmltemplate.Must(htmltemplate.New("candidate").Funcs(htmltemplate.FuncMap{
+	"cell":   problemScoreCell,
+	"failed": failedTestCasesText,
+	"join":   strings.Join,
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.User.Email}}: {{.Contest.ShortName}}</title>
+<style>
+body { font-family: -apple-system, "Segoe UI", Helvetica, Arial, sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; }
+td.solved { background: #60e760; }
+td.pending { background: #6666ff; color: #fff; }
+td.failed { background: #e87272; }
+td.correct { color: #1a7f1a; font-weight: bold; }
+pre { background: #f6f8fa; padding: 1em; font-size: 12px; overflow-x: auto; }
+.meta { color: #666; }
+</style>
+</head>
+<body>
+<h1>{{.User.Email}}</h1>
+<table>
+<tr><th>Contest</th><td>{{.Contest.Name}} ({{.Contest.ShortName}})</td></tr>
+<tr><th>Username</th><td>{{.User.Username}}</td></tr>
+<tr><th>Rank</th><td>{{if .Rank}}{{.Rank}} of {{.Candidates}}{{else}}unranked{{end}}</td></tr>
+<tr><th>Points</th><td>{{.Points}}, total time {{.TotalTime}}</td></tr>
+<tr><th>Languages</th><td>{{join .Languages ", "}}</td></tr>
+</table>
+<p class="meta">Generated {{.GeneratedAt.Format "2006-01-02 15:04:05 MST"}}</p>
+<h2>Problems</h2>
+<table>
+<tr>{{range .Problems}}<th>{{.ShortName}}</th>{{end}}</tr>
+<tr>{{range .Problems}}<td class="{{if .Solved}}solved{{else if gt .Pending 0}}pending{{else if gt .Submissions 0}}failed{{end}}">{{cell .ProblemScore}}</td>{{end}}</tr>
+</table>
+<h2>Timeline</h2>
+{{if .Submissions}}<table>
+<tr><th>minute</th><th>submitted</th><th>problem</th><th>language</th><th>verdict</th><th>failed test cases</th></tr>
+{{range .Submissions}}<tr><td>{{.ContestTime}}</td><td>{{.SubmitTime}}</td><td>{{.Problem}}</td><td>{{.LangId}}</td><td{{if eq .Verdict "correct"}} class="correct"{{end}}>{{.Verdict}}</td><td>{{failed .Failed}}</td></tr>
+{{end}}</table>{{else}}<p>No submissions.</p>{{end}}
+<h2>Accepted sources</h2>
+{{range .Problems}}<h3>{{.ShortName}}</h3>
+{{if .Accepted}}<p class="meta">Submission {{.Accepted.SubmitId}} at minute {{.Accepted.ContestTime}} in {{.Accepted.LangId}}</p>
+<pre>{{.Source}}</pre>
+{{else}}<p>Not solved.</p>
+{{end}}{{end}}
+</body>
+</html>
+`))
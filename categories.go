@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Get team category from mysql db by categoryid (if numeric) or name
+func GetCategoryByRef(categoryRef string, db *gorm.DB) (category TeamCategory, err error) {
+	var categories []TeamCategory
+	query := db.Table("team_category").Limit(1)
+	if categoryId, convErr := strconv.Atoi(categoryRef); convErr == nil {
+		query = query.Where("categoryid = ?", categoryId)
+	} else {
+		query = query.Where("name = ?", categoryRef)
+	}
+	if err = query.Find(&categories).Error; err != nil {
+		return category, PrintErr("READ_CATEGORY_ERR", fmt.Sprintf("(category %s): %v", categoryRef, err))
+	}
+	if len(categories) == 0 {
+		return category, PrintErr("CATEGORY_NOT_FOUND", fmt.Sprintf("(category %s)", categoryRef))
+	}
+	return categories[0], nil
+}
+
+// Create a new team category in team_category table (categoryid is auto incremented by mysql)
+// Teams in a category which is not visible are hidden from the public scoreboard
+func CreateCategory(name string, sortOrder int, color string, visible bool, db *gorm.DB) (category TeamCategory, err error) {
+	var categories []TeamCategory
+	if err = db.Table("team_category").Limit(1).Where("name = ?", name).Find(&categories).Error; err != nil {
+		return category, PrintErr("READ_CATEGORY_ERR", fmt.Sprintf("(category %s): %v", name, err))
+	}
+	if len(categories) > 0 {
+		log.Printf("CATEGORY_ALREADY_PRESENT: (name: %s, categoryid: %d)\n", name, categories[0].CategoryId)
+		return categories[0], nil
+	}
+
+	category = TeamCategory{
+		Name:      name,
+		SortOrder: sortOrder,
+		Visible:   0,
+	}
+	if visible {
+		category.Visible = 1
+	}
+	if color != "" {
+		category.Color = &color
+	}
+	PrintVal("NEW_CATEGORY", category)
+	if err = db.Table("team_category").Create(&category).Error; err != nil {
+		return category, PrintErr("INSERT_CATEGORY_TABLE_ERR", fmt.Sprintf("Error inserting %s into 'team_category' table: %v", name, err))
+	}
+	return category, nil
+}
+
+// Print all team categories with the number of teams in each of them
+func ListCategories(config *Config) (err error) {
+	sqlQuery := `SELECT c.categoryid, c.name, c.sortorder, COALESCE(c.color, ''), c.visible, COUNT(t.teamid)
+		FROM team_category c LEFT JOIN team t ON t.categoryid = c.categoryid
+		GROUP BY c.categoryid, c.name, c.sortorder, c.color, c.visible ORDER BY c.sortorder, c.categoryid`
+	rows, err := config.Db.Raw(sqlQuery).Rows()
+	if err != nil {
+		return PrintErr("READ_CATEGORIES_ERR", fmt.Sprintf("%v", err))
+	}
+	defer rows.Close()
+
+	fmt.Printf("categoryid\tname\tsortorder\tcolor\tvisible\tteams\n")
+	for rows.Next() {
+		var category TeamCategory
+		var color string
+		var teams int
+		if err = rows.Scan(&category.CategoryId, &category.Name, &category.SortOrder, &color, &category.Visible, &teams); err != nil {
+			return PrintErr("FETCH_CATEGORY_ERR", fmt.Sprintf("%v", err))
+		}
+		fmt.Printf("%d\t%s\t%d\t%s\t%d\t%d\n", category.CategoryId, category.Name, category.SortOrder, color, category.Visible, teams)
+	}
+	return nil
+}
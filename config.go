@@ -6,7 +6,9 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"os"
+	"time"
 
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/jinzhu/gorm"
@@ -24,6 +26,18 @@ func PrintErr(code string, msg string) error {
 	return fmt.Errorf(pmsg)
 }
 
+// Ops which are not performed on a contest and so do not need contest-short-name
+var contestFreeOps = map[string]bool{
+	"CREATE_AFFILIATION": true,
+	"LIST_AFFILIATIONS":  true,
+	"DELETE_AFFILIATION": true,
+	"CREATE_CATEGORY":    true,
+	"LIST_CATEGORIES":    true,
+	"SHOW_AUDIT":         true,
+	"RESTORE":            true,
+	"SERVE":              true,
+}
+
 // Validate if configuration details have been provided correctly for this service
 func ValidateConfig(cliArgs *CliArgs) (err error) {
 	if cliArgs.Op == "" {
@@ -32,10 +46,25 @@ func ValidateConfig(cliArgs *CliArgs) (err error) {
 	if cliArgs.DbConnStr == "" {
 		return PrintErr("CLI_ARG_ERR", "db-conn-str arg missing")
 	}
-	if cliArgs.ContestShortName == "" {
+	if cliArgs.ContestShortName == "" && !contestFreeOps[cliArgs.Op] {
 		return PrintErr("CLI_ARG_ERR", "contest-short-name arg missing")
 	}
 
+	loc, err := time.LoadLocation(cliArgs.Timezone)
+	if err != nil || cliArgs.Timezone == "Local" {
+		return PrintErr("CLI_ARG_ERR", fmt.Sprintf("timezone arg %s is not an IANA zone name: %v", cliArgs.Timezone, err))
+	}
+
+	if cliArgs.Concurrency < 1 || cliArgs.Concurrency > 64 {
+		return PrintErr("CLI_ARG_ERR", fmt.Sprintf("concurrency arg %d must be between 1 and 64", cliArgs.Concurrency))
+	}
+	if cliArgs.UsernameScheme != "prefix" && cliArgs.UsernameScheme != "email" && cliArgs.UsernameScheme != "random" {
+		return PrintErr("CLI_ARG_ERR", fmt.Sprintf("username-scheme arg %s must be one of prefix, email, random", cliArgs.UsernameScheme))
+	}
+	if cliArgs.Preview && cliArgs.Op != "ADD_USERS" && cliArgs.Op != "RESEND_EMAIL_USERS" {
+		return PrintErr("CLI_ARG_ERR", "preview arg is only supported for ops ADD_USERS, RESEND_EMAIL_USERS")
+	}
+
 	switch cliArgs.Op {
 	case "CREATE_CONTEST":
 		if cliArgs.ContestName == "" || cliArgs.ContestDurationHours == 0 {
@@ -46,18 +75,54 @@ func ValidateConfig(cliArgs *CliArgs) (err error) {
 				return PrintErr("CLI_ARG_ERR", "contest-duration-hours arg missing")
 			}
 		}
-	case "ADD_USERS":
+		if _, err = ParseContestProblems(cliArgs.Problems); err != nil {
+			return PrintErr("CLI_ARG_ERR", fmt.Sprintf("problems arg: %v", err))
+		}
+		if err = validateStartTime(cliArgs.StartTime, loc); err != nil {
+			return err
+		}
+		if cliArgs.FreezeBeforeEnd != "" {
+			freezeBeforeEnd, err := time.ParseDuration(cliArgs.FreezeBeforeEnd)
+			if err != nil {
+				return PrintErr("CLI_ARG_ERR", fmt.Sprintf("freeze-before-end arg: %v", err))
+			}
+			if freezeBeforeEnd < 0 || freezeBeforeEnd > time.Duration(cliArgs.ContestDurationHours)*time.Hour {
+				return PrintErr("CLI_ARG_ERR", fmt.Sprintf("freeze-before-end arg %s must be between 0 and contest-duration-hours", cliArgs.FreezeBeforeEnd))
+			}
+		}
+	case "CLONE_CONTEST":
+		if cliArgs.From == "" {
+			return PrintErr("CLI_ARG_ERR", "from arg missing")
+		}
+		if cliArgs.From == cliArgs.ContestShortName {
+			return PrintErr("CLI_ARG_ERR", "from arg must be different from contest-short-name")
+		}
+		if err = validateStartTime(cliArgs.StartTime, loc); err != nil {
+			return err
+		}
+	case "ADD_USERS", "RESEND_EMAIL_USERS":
 		if cliArgs.UsersFile == "" {
 			return PrintErr("CLI_ARG_ERR", "users-file arg missing")
 		}
 		if _, err = os.Stat(cliArgs.UsersFile); os.IsNotExist(err) {
 			return PrintErr("USER_FILE_NOT_EXIST", fmt.Sprintf("user-file arg file not found: %v", err))
 		}
-		if cliArgs.SendwithusApiKey != "" {
-			if cliArgs.SendwithusReplyTo == "" || cliArgs.SendwithusTemplateId == "" || cliArgs.SendwithusFrom == "" || cliArgs.SendwithusFromName == "" || cliArgs.ContestUrl == "" {
-				return PrintErr("SENDWITHUS_DETAILS_MISSING",
-					fmt.Sprintf("if sendwithus-api-key is set, then both sendwithus-template-id, sendwithus-reply-to, sendwithus-from, contest-url and sendwithus-from-name must be present"))
-			}
+		if err = validateEmailBackend(cliArgs); err != nil {
+			return err
+		}
+	case "CREATE_CATEGORY":
+		if cliArgs.CategoryName == "" {
+			return PrintErr("CLI_ARG_ERR", "category-name arg missing")
+		}
+	case "LIST_CATEGORIES":
+	case "CREATE_AFFILIATION":
+		if cliArgs.AffiliationShortName == "" {
+			return PrintErr("CLI_ARG_ERR", "affiliation-short-name arg missing")
+		}
+	case "LIST_AFFILIATIONS":
+	case "DELETE_AFFILIATION":
+		if cliArgs.AffiliationShortName == "" {
+			return PrintErr("CLI_ARG_ERR", "affiliation-short-name arg missing")
 		}
 	case "DELETE_CONTEST":
 	case "DELETE_USERS":
@@ -71,6 +136,98 @@ func ValidateConfig(cliArgs *CliArgs) (err error) {
 		if cliArgs.ResultsFile == "" {
 			return PrintErr("CLI_ARG_ERR", "results-file arg missing")
 		}
+		if !resultsFormats[cliArgs.ResultsFormat] {
+			return PrintErr("CLI_ARG_ERR", fmt.Sprintf("results-format arg %s must be one of tsv, csv, json, ndjson, markdown, html", cliArgs.ResultsFormat))
+		}
+		if cliArgs.Append && !appendableResultsFormats[cliArgs.ResultsFormat] {
+			return PrintErr("CLI_ARG_ERR", fmt.Sprintf("append arg is not supported for results-format %s", cliArgs.ResultsFormat))
+		}
+	case "RESTORE":
+		if cliArgs.Journal == "" {
+			return PrintErr("CLI_ARG_ERR", "journal arg missing")
+		}
+		if _, err = os.Stat(cliArgs.Journal); os.IsNotExist(err) {
+			return PrintErr("JOURNAL_NOT_EXIST", fmt.Sprintf("journal arg file not found: %v", err))
+		}
+	case "EXPORT_SUBMISSIONS":
+		if cliArgs.OutputDir == "" {
+			return PrintErr("CLI_ARG_ERR", "output-dir arg missing")
+		}
+	case "SIMILARITY_REPORT":
+		if cliArgs.ReportFile == "" {
+			return PrintErr("CLI_ARG_ERR", "report-file arg missing")
+		}
+		if cliArgs.SimilarityThreshold <= 0 || cliArgs.SimilarityThreshold > 1 {
+			return PrintErr("CLI_ARG_ERR", fmt.Sprintf("similarity-threshold arg %v must be above 0 and at most 1", cliArgs.SimilarityThreshold))
+		}
+	case "CANDIDATE_REPORT":
+		if cliArgs.Email == "" {
+			return PrintErr("CLI_ARG_ERR", "email arg missing")
+		}
+		if cliArgs.ReportFile == "" {
+			return PrintErr("CLI_ARG_ERR", "report-file arg missing")
+		}
+		if !candidateReportFormats[cliArgs.ReportFormat] {
+			return PrintErr("CLI_ARG_ERR", fmt.Sprintf("report-format arg %s must be one of markdown, html", cliArgs.ReportFormat))
+		}
+	case "SERVE":
+		if cliArgs.DryRun || cliArgs.Preview {
+			return PrintErr("CLI_ARG_ERR", "dry-run and preview args are not supported for op SERVE")
+		}
+		if cliArgs.Listen == "" || cliArgs.JobsDir == "" {
+			return PrintErr("CLI_ARG_ERR", "listen and jobs-dir args must not be empty")
+		}
+		// Jobs show candidates' credentials and can delete contests, only the local machine may use them without a token
+		if cliArgs.ApiToken == "" && !isLoopbackListen(cliArgs.Listen) {
+			return PrintErr("CLI_ARG_ERR", fmt.Sprintf("api-token arg missing, it is required unless listen is a loopback address (e.g. 127.0.0.1:8080), not %s", cliArgs.Listen))
+		}
+	case "SHOW_AUDIT":
+		if !cliArgs.AuditTable && cliArgs.AuditFile == "" {
+			return PrintErr("CLI_ARG_ERR", "audit-file arg missing")
+		}
+	}
+	return nil
+}
+
+// Validate details needed by the chosen email-backend
+func validateEmailBackend(cliArgs *CliArgs) (err error) {
+	switch cliArgs.EmailBackend {
+	case "":
+		return nil
+	case "sendwithus":
+		if cliArgs.SendwithusApiKey == "" || cliArgs.SendwithusReplyTo == "" || cliArgs.SendwithusTemplateId == "" {
+			return PrintErr("SENDWITHUS_DETAILS_MISSING",
+				fmt.Sprintf("if email-backend is sendwithus, then sendwithus-api-key, sendwithus-template-id and sendwithus-reply-to must be present"))
+		}
+	case "smtp":
+		if cliArgs.SmtpHost == "" {
+			return PrintErr("SMTP_DETAILS_MISSING", "if email-backend is smtp, then smtp-host must be present")
+		}
+	case "file":
+		if cliArgs.EmailDir == "" {
+			return PrintErr("EMAIL_DIR_MISSING", "if email-backend is file, then email-dir must be present")
+		}
+	default:
+		return PrintErr("CLI_ARG_ERR", fmt.Sprintf("email-backend arg %s must be one of sendwithus, smtp, file", cliArgs.EmailBackend))
+	}
+	if cliArgs.SendwithusFrom == "" || cliArgs.SendwithusFromName == "" || cliArgs.ContestUrl == "" {
+		return PrintErr("EMAIL_DETAILS_MISSING",
+			fmt.Sprintf("if email-backend is set, then sendwithus-from, sendwithus-from-name and contest-url must be present"))
+	}
+	return nil
+}
+
+// Validate optional start-time arg (must parse in timezone and be in the future)
+func validateStartTime(startTime string, loc *time.Location) (err error) {
+	if startTime == "" {
+		return nil
+	}
+	startAt, err := ParseContestStartTime(startTime, loc)
+	if err != nil {
+		return PrintErr("CLI_ARG_ERR", fmt.Sprintf("start-time arg: %v", err))
+	}
+	if startAt.Before(time.Now()) {
+		return PrintErr("CLI_ARG_ERR", fmt.Sprintf("start-time arg %s is in the past", startTime))
 	}
 	return nil
 }
@@ -93,19 +250,60 @@ func ParseConfigFile(filename string) (cliArgs *CliArgs, err error) {
 func ParseCliArgs() (cliArgs *CliArgs, err error) {
 	config := flag.String("config", "", "Config file (OPTIONAL: For ease of use)")
 	op := flag.String("op", "", "Which operation to perform (MANDATORY)")
-	contestName := flag.String("contest-name", "", "Contest name (MANDATORY for op's: CREATE_CONTEST)")
-	contestShortName := flag.String("contest-short-name", "", "Contest short name (MANDATORY)")
-	contestDurationHours := flag.Int("contest-duration-hours", 0, "Contest duration hours (MANDATORY for op's: CREATE_CONTEST, START_CONTEST)")
+	contestName := flag.String("contest-name", "", "Contest name (MANDATORY for op's: CREATE_CONTEST, OPTIONAL for op's: CLONE_CONTEST)")
+	contestShortName := flag.String("contest-short-name", "", "Contest short name (MANDATORY except for affiliation and category op's)")
+	contestDurationHours := flag.Int("contest-duration-hours", 0, "Contest duration hours (MANDATORY for op's: CREATE_CONTEST, OPTIONAL for op's: START_CONTEST to reset end time)")
+	from := flag.String("from", "", "Short name of contest to copy problems, timings and flags from (MANDATORY for op's: CLONE_CONTEST)")
+	category := flag.String("category", "", "Team category id or name for all users without a category column (OPTIONAL for op's: ADD_USERS, defaults to 3)")
+	categoryName := flag.String("category-name", "", "Team category name (MANDATORY for op's: CREATE_CATEGORY)")
+	categorySortOrder := flag.Int("category-sortorder", 0, "Team category sort order on scoreboard (OPTIONAL for op's: CREATE_CATEGORY)")
+	categoryColor := flag.String("category-color", "", "Team category background color on scoreboard, e.g. #ffcccc (OPTIONAL for op's: CREATE_CATEGORY)")
+	categoryHidden := flag.Bool("category-hidden", false, "Hide teams of category from public scoreboard, e.g. for staff test accounts (OPTIONAL for op's: CREATE_CATEGORY)")
+	affiliationShortName := flag.String("affiliation-short-name", "", "Team affiliation short name (MANDATORY for op's: CREATE_AFFILIATION, DELETE_AFFILIATION, OPTIONAL for op's: ADD_USERS as default affiliation of all users, created if missing)")
+	affiliationName := flag.String("affiliation-name", "", "Team affiliation full name, e.g. college name (OPTIONAL for op's: CREATE_AFFILIATION, defaults to affiliation-short-name)")
+	affiliationCountry := flag.String("affiliation-country", "", "Team affiliation ISO 3166-1 alpha-3 country code, e.g. IND (OPTIONAL for op's: CREATE_AFFILIATION)")
+	problems := flag.String("problems", "", "Comma separated problems to add to contest as [LETTER=]problem[:points[:color[:allow_submit[:allow_judge]]]] where problem is externalid or probid (OPTIONAL for op's: CREATE_CONTEST)")
+	startTime := flag.String("start-time", "", "Contest start time as YYYY-MM-DD HH:MM[:SS] in timezone (OPTIONAL for op's: CREATE_CONTEST, CLONE_CONTEST, defaults to now)")
+	freezeBeforeEnd := flag.String("freeze-before-end", "", "Freeze scoreboard this long before contest end, e.g. 30m or 1h (OPTIONAL for op's: CREATE_CONTEST, defaults to freezing right after start)")
+	timezone := flag.String("timezone", "", "IANA timezone name for contest times, e.g. Asia/Kolkata or America/New_York (OPTIONAL, defaults to Asia/Kolkata)")
 	userFile := flag.String("users-file", "", "Users file to add users by email_id (MANDATORY for op's: ADD_USERS)")
+	concurrency := flag.Int("concurrency", 0, "Number of users to process in parallel (OPTIONAL for op's: ADD_USERS, RESEND_EMAIL_USERS, DELETE_USERS, defaults to 1)")
+	usernameScheme := flag.String("username-scheme", "", "How to generate usernames of new users: prefix (prefix + teamid), email (slug of email) or random (prefix + random handle) (OPTIONAL for op's: ADD_USERS, defaults to prefix)")
+	usernamePrefix := flag.String("username-prefix", "", "Prefix of generated usernames (OPTIONAL for op's: ADD_USERS, defaults to user)")
 	resultsFile := flag.String("results-file", "", "Results file to output contest results to (MANDATORY for op's: SHOW_RESULTS)")
+	resultsFormat := flag.String("results-format", "", "Format of results-file: tsv, csv, json, ndjson, markdown or html (OPTIONAL for op's: SHOW_RESULTS, defaults to tsv)")
+	appendResults := flag.Bool("append", false, "Append to results-file instead of overwriting it, only for tsv, csv, ndjson and markdown (OPTIONAL for op's: SHOW_RESULTS)")
+	outputDir := flag.String("output-dir", "", "Directory to export submissions source code and manifest.json to (MANDATORY for op's: EXPORT_SUBMISSIONS)")
+	reportFile := flag.String("report-file", "", "File to write report to (MANDATORY for op's: SIMILARITY_REPORT, CANDIDATE_REPORT)")
+	reportFormat := flag.String("report-format", "", "Format of report-file: markdown or html (OPTIONAL for op's: CANDIDATE_REPORT, defaults to markdown, SIMILARITY_REPORT is always html)")
+	similarityThreshold := flag.Float64("similarity-threshold", 0, "Report pairs of submissions at least this similar, between 0 and 1 (OPTIONAL for op's: SIMILARITY_REPORT, defaults to 0.8)")
+	listen := flag.String("listen", "", "Address to serve the REST API on (OPTIONAL for op's: SERVE, defaults to 127.0.0.1:8080)")
+	apiToken := flag.String("api-token", "", "Token REST API requests must send as 'Authorization: Bearer <token>' (MANDATORY for op's: SERVE unless listen is a loopback address)")
+	jobsDir := flag.String("jobs-dir", "", "Directory for users files, user details files and journals of REST API jobs (OPTIONAL for op's: SERVE, defaults to jobs)")
 	dbConnStr := flag.String("db-conn-str", "", "Mysql db to connect to create users (MANDATORY)")
 	sendwithusApiKey := flag.String("sendwithus-api-key", "", "Sendwithus api key to send userid/password emails using sendwithus to all users (OPTIONAL for op ADD_USERS)")
 	sendwithusTemplateId := flag.String("sendwithus-template-id", "", "Sendwithus template id to send userid/password emails using sendwithus to all users (OPTIONAL for op ADD_USERS)")
-	sendwithusReplyTo := flag.String("sendwithus-reply-to", "", "Sendwithus reply to value to send userid/password emails using sendwithus to all users (OPTIONAL for op ADD_USERS, but MANDATORY if sendwithusApiKey is mentioned)")
-	sendwithusFrom := flag.String("sendwithus-from", "", "Sendwithus from value to send userid/password emails using sendwithus to all users (OPTIONAL for op ADD_USERS, but MANDATORY if sendwithusApiKey is mentioned)")
-	sendwithusFromName := flag.String("sendwithus-from-name", "", "Sendwithus from-name value to send userid/password emails using sendwithus to all users (OPTIONAL for op ADD_USERS, but MANDATORY if sendwithusApiKey is mentioned)")
-	sendwithusFromCc := flag.String("sendwithus-cc", "", "Sendwithus cc value to send userid/password emails using sendwithus to all users (OPTIONAL for op ADD_USERS, but MANDATORY if sendwithusApiKey is mentioned)")
+	sendwithusReplyTo := flag.String("sendwithus-reply-to", "", "Reply to value of userid/password emails to all users (OPTIONAL for op ADD_USERS, used by all email backends, but MANDATORY if sendwithusApiKey is mentioned)")
+	sendwithusFrom := flag.String("sendwithus-from", "", "From value of userid/password emails to all users (OPTIONAL for op ADD_USERS, used by all email backends, MANDATORY if email-backend is set)")
+	sendwithusFromName := flag.String("sendwithus-from-name", "", "From-name value of userid/password emails to all users (OPTIONAL for op ADD_USERS, used by all email backends, MANDATORY if email-backend is set)")
+	sendwithusFromCc := flag.String("sendwithus-cc", "", "Comma separated bcc email ids of userid/password emails to all users (OPTIONAL for op ADD_USERS, used by all email backends)")
 	contestUrl := flag.String("contest-url", "", "Contest URL (MANDATORY for op's: ADD_USERS)")
+	emailBackend := flag.String("email-backend", "", "Email backend to send userid/password emails with: sendwithus, smtp or file (OPTIONAL for op's: ADD_USERS, RESEND_EMAIL_USERS, defaults to sendwithus if sendwithus-api-key is set)")
+	smtpHost := flag.String("smtp-host", "", "SMTP server host (MANDATORY if email-backend is smtp)")
+	smtpPort := flag.Int("smtp-port", 0, "SMTP server port (OPTIONAL if email-backend is smtp, defaults to 587)")
+	smtpUsername := flag.String("smtp-username", "", "SMTP username (OPTIONAL if email-backend is smtp)")
+	smtpPassword := flag.String("smtp-password", "", "SMTP password (OPTIONAL if email-backend is smtp)")
+	smtpSkipStartTls := flag.Bool("smtp-skip-starttls", false, "Send emails without STARTTLS, only for local SMTP stand-ins (OPTIONAL if email-backend is smtp)")
+	emailDir := flag.String("email-dir", "", "Directory to write .eml files to (MANDATORY if email-backend is file)")
+	emailTemplatesDir := flag.String("email-templates-dir", "", "Directory with welcome.subject.tmpl, welcome.txt.tmpl and welcome.html.tmpl email templates (OPTIONAL, defaults to the templates built into the binary)")
+	dryRun := flag.Bool("dry-run", false, "Run the op without committing anything to the database, sending emails or writing user details files, and print a plan of every change instead (OPTIONAL for all op's)")
+	auditFile := flag.String("audit-file", "", "File to append a JSON line to for every user and contest created, deleted or reset (OPTIONAL, defaults to domjudge-interview.audit.jsonl, read by op's: SHOW_AUDIT)")
+	auditTable := flag.Bool("audit-table", false, "Also record audit entries in "+auditTable+" table of DOMJudge database, created if missing (OPTIONAL, read by op's: SHOW_AUDIT instead of audit-file)")
+	operator := flag.String("operator", "", "Name of person running this service recorded in audit entries (OPTIONAL, defaults to $USER)")
+	email := flag.String("email", "", "Email of user to show audit entries of or to report on (OPTIONAL for op's: SHOW_AUDIT, MANDATORY for op's: CANDIDATE_REPORT)")
+	journal := flag.String("journal", "", "Undo journal file of rows deleted (OPTIONAL for op's: DELETE_USERS, DELETE_CONTEST, defaults to <contest-short-name>.<time>.journal.jsonl, MANDATORY for op's: RESTORE)")
+	keepSubmissions := flag.Bool("keep-submissions", false, "Archive the contest instead of deleting it: keep the contest, its teams, submissions and judgings and delete only users, balloons, scoreboard caches, clarifications and events (OPTIONAL for op's: DELETE_CONTEST)")
+	preview := flag.Bool("preview", false, "Print welcome email of first user in users-file to stdout without changing the database or sending emails (OPTIONAL for op's: ADD_USERS, RESEND_EMAIL_USERS)")
 
 	flag.Parse()
 
@@ -121,8 +319,33 @@ func ParseCliArgs() (cliArgs *CliArgs, err error) {
 		ContestName:          getLastStr(cliArgs.ContestName, *contestName),
 		ContestShortName:     getLastStr(cliArgs.ContestShortName, *contestShortName),
 		ContestDurationHours: getLastInt(cliArgs.ContestDurationHours, *contestDurationHours),
+		From:                 getLastStr(cliArgs.From, *from),
+		Category:             getLastStr(cliArgs.Category, *category),
+		CategoryName:         getLastStr(cliArgs.CategoryName, *categoryName),
+		CategorySortOrder:    getLastInt(cliArgs.CategorySortOrder, *categorySortOrder),
+		CategoryColor:        getLastStr(cliArgs.CategoryColor, *categoryColor),
+		CategoryHidden:       cliArgs.CategoryHidden || *categoryHidden,
+		AffiliationShortName: getLastStr(cliArgs.AffiliationShortName, *affiliationShortName),
+		AffiliationName:      getLastStr(cliArgs.AffiliationName, *affiliationName),
+		AffiliationCountry:   getLastStr(cliArgs.AffiliationCountry, *affiliationCountry),
+		Problems:             getLastStr(cliArgs.Problems, *problems),
+		StartTime:            getLastStr(cliArgs.StartTime, *startTime),
+		FreezeBeforeEnd:      getLastStr(cliArgs.FreezeBeforeEnd, *freezeBeforeEnd),
+		Timezone:             getLastStr(getLastStr("Asia/Kolkata", cliArgs.Timezone), *timezone),
 		UsersFile:            getLastStr(cliArgs.UsersFile, *userFile),
+		Concurrency:          getLastInt(getLastInt(1, cliArgs.Concurrency), *concurrency),
+		UsernameScheme:       getLastStr(getLastStr("prefix", cliArgs.UsernameScheme), *usernameScheme),
+		UsernamePrefix:       getLastStr(getLastStr("user", cliArgs.UsernamePrefix), *usernamePrefix),
 		ResultsFile:          getLastStr(cliArgs.ResultsFile, *resultsFile),
+		ResultsFormat:        getLastStr(getLastStr("tsv", cliArgs.ResultsFormat), *resultsFormat),
+		Append:               cliArgs.Append || *appendResults,
+		OutputDir:            getLastStr(cliArgs.OutputDir, *outputDir),
+		ReportFile:           getLastStr(cliArgs.ReportFile, *reportFile),
+		ReportFormat:         getLastStr(getLastStr("markdown", cliArgs.ReportFormat), *reportFormat),
+		Listen:               getLastStr(getLastStr("127.0.0.1:8080", cliArgs.Listen), *listen),
+		ApiToken:             getLastStr(cliArgs.ApiToken, *apiToken),
+		JobsDir:              getLastStr(getLastStr("jobs", cliArgs.JobsDir), *jobsDir),
+		SimilarityThreshold:  getLastFloat(getLastFloat(0.8, cliArgs.SimilarityThreshold), *similarityThreshold),
 		DbConnStr:            getLastStr(cliArgs.DbConnStr, *dbConnStr),
 		SendwithusApiKey:     getLastStr(cliArgs.SendwithusApiKey, *sendwithusApiKey),
 		SendwithusTemplateId: getLastStr(cliArgs.SendwithusTemplateId, *sendwithusTemplateId),
@@ -131,11 +354,47 @@ func ParseCliArgs() (cliArgs *CliArgs, err error) {
 		SendwithusFromName:   getLastStr(cliArgs.SendwithusFromName, *sendwithusFromName),
 		SendwithusCc:         getLastStr(cliArgs.SendwithusCc, *sendwithusFromCc),
 		ContestUrl:           getLastStr(cliArgs.ContestUrl, *contestUrl),
+		EmailBackend:         getLastStr(cliArgs.EmailBackend, *emailBackend),
+		SmtpHost:             getLastStr(cliArgs.SmtpHost, *smtpHost),
+		SmtpPort:             getLastInt(getLastInt(587, cliArgs.SmtpPort), *smtpPort),
+		SmtpUsername:         getLastStr(cliArgs.SmtpUsername, *smtpUsername),
+		SmtpPassword:         getLastStr(cliArgs.SmtpPassword, *smtpPassword),
+		SmtpSkipStartTls:     cliArgs.SmtpSkipStartTls || *smtpSkipStartTls,
+		EmailDir:             getLastStr(cliArgs.EmailDir, *emailDir),
+		EmailTemplatesDir:    getLastStr(cliArgs.EmailTemplatesDir, *emailTemplatesDir),
+		Preview:              cliArgs.Preview || *preview,
+		DryRun:               cliArgs.DryRun || *dryRun,
+		AuditFile:            getLastStr(getLastStr("domjudge-interview.audit.jsonl", cliArgs.AuditFile), *auditFile),
+		AuditTable:           cliArgs.AuditTable || *auditTable,
+		Operator:             getLastStr(getLastStr(DefaultOperator(), cliArgs.Operator), *operator),
+		Email:                getLastStr(cliArgs.Email, *email),
+		Journal:              getLastStr(cliArgs.Journal, *journal),
+		KeepSubmissions:      cliArgs.KeepSubmissions || *keepSubmissions,
+	}
+	if cliArgs.EmailBackend == "" && cliArgs.SendwithusApiKey != "" {
+		cliArgs.EmailBackend = "sendwithus"
+	}
+	if cliArgs.DryRun && cliArgs.Concurrency > 1 {
+		log.Printf("DRY_RUN: dry run uses a single database connection, ignoring concurrency %d\n", cliArgs.Concurrency)
+		cliArgs.Concurrency = 1
 	}
 	err = ValidateConfig(cliArgs)
 	return cliArgs, err
 }
 
+// Whether a listen address (host:port) only accepts connections from the local machine
+func isLoopbackListen(listen string) bool {
+	host, _, err := net.SplitHostPort(listen)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
 func getLastStr(str1 string, str2 string) string {
 	if str2 != "" {
 		return str2
@@ -150,6 +409,13 @@ func getLastInt(v1 int, v2 int) int {
 	return v1
 }
 
+func getLastFloat(v1 float64, v2 float64) float64 {
+	if v2 != 0 {
+		return v2
+	}
+	return v1
+}
+
 func NewConfig() (config *Config, err error) {
 	cliArgs, err := ParseCliArgs()
 	if err != nil {
@@ -158,13 +424,53 @@ func NewConfig() (config *Config, err error) {
 
 	// dbConnStr := "domjudge:djpw@domjudge-db.c97ivjugwy4b.us-east-1.rds.amazonaws.com:3306/domjudge_interview?charset=utf8&parseTime=True&loc=Local"
 	dbConnStr := cliArgs.DbConnStr
-	db, err := gorm.Open("mysql", dbConnStr)
+	var db *gorm.DB
+	var plan *DryRunPlan
+	if cliArgs.DryRun {
+		plan = new(DryRunPlan)
+		db, err = gorm.Open("mysql", OpenDryRunDb(dbConnStr, plan))
+	} else {
+		db, err = gorm.Open("mysql", dbConnStr)
+	}
 	if err != nil {
 		return nil, PrintErr("DB_CONN_ERR", fmt.Sprintf("Could not connect to %s: %v", dbConnStr, err))
 	}
+	audit, err := NewAuditLog(cliArgs, db, plan)
+	if err != nil {
+		return nil, err
+	}
+	// Destructive ops save every row they delete to an undo journal first
+	var journal *Journal
+	if cliArgs.Op == "DELETE_USERS" || cliArgs.Op == "DELETE_CONTEST" {
+		journalFilename := getLastStr(DefaultJournalFilename(cliArgs.ContestShortName), cliArgs.Journal)
+		if journal, err = NewJournal(journalFilename, plan); err != nil {
+			return nil, err
+		}
+	}
+	loc, _ := time.LoadLocation(cliArgs.Timezone)
+	emailSender, err := NewEmailSender(cliArgs)
+	if err != nil {
+		return nil, err
+	}
+	// Emails are rendered locally for all backends except sendwithus, which renders its own template
+	var emailTemplates *WelcomeEmailTemplates
+	if (emailSender != nil && cliArgs.EmailBackend != "sendwithus") || cliArgs.Preview {
+		if emailTemplates, err = LoadWelcomeEmailTemplates(cliArgs.EmailTemplatesDir); err != nil {
+			return nil, err
+		}
+	}
+	if plan != nil && emailSender != nil {
+		emailSender = &DryRunSender{Plan: plan, Backend: cliArgs.EmailBackend}
+	}
 	config = &Config{
-		CliArgs: cliArgs,
-		Db:      db,
+		CliArgs:        cliArgs,
+		Db:             db,
+		Location:       loc,
+		EmailSender:    emailSender,
+		EmailTemplates: emailTemplates,
+		Plan:           plan,
+		Audit:          audit,
+		Journal:        journal,
 	}
 	return config, nil
 }
@@ -3,19 +3,29 @@ package main
 import (
 	"fmt"
 	"log"
-	"os"
+	"strings"
 	"time"
+
+	"github.com/jinzhu/gorm"
 )
 
 // Build new contest object
-func BuildNewContest(name string, shortName string, durationHours int) (contest Contest) {
+// Contest starts at startTime (10 seconds from now if startTime is zero) and is activated right away.
+// Scoreboard is frozen freezeBeforeEnd before the end (10 seconds after start if freezeBeforeEnd is zero)
+func BuildNewContest(name string, shortName string, durationHours int, startAt time.Time, freezeBeforeEnd time.Duration, loc *time.Location) (contest Contest) {
 	nowTime := time.Now().Unix()
 	activateTime := float64(nowTime) + 0.00
 	startTime := activateTime + 10.00
-	freezeTime := activateTime + 20.00
+	if !startAt.IsZero() {
+		startTime = float64(startAt.Unix())
+	}
 	endTime := startTime + float64(durationHours*3600)
+	freezeTime := startTime + 10.00
+	if freezeBeforeEnd > 0 {
+		freezeTime = endTime - freezeBeforeEnd.Seconds()
+	}
 	unfreezeTime := endTime + 10.00
-	deactivateTime := activateTime + float64(60*86400) // deactivate after 2 months
+	deactivateTime := startTime + float64(60*86400) // deactivate 2 months after start
 
 	return Contest{
 		Name:           name,
@@ -28,12 +38,12 @@ func BuildNewContest(name string, shortName string, durationHours int) (contest
 		UnfreezeTime:   unfreezeTime,
 		DeactivateTime: deactivateTime,
 
-		ActivateTimeString:   time.Unix(int64(activateTime), 0).Format("2006-01-02 15:04:05 Asia/Kolkata"),
-		StartTimeString:      time.Unix(int64(startTime), 0).Format("2006-01-02 15:04:05 Asia/Kolkata"),
-		FreezeTimeString:     time.Unix(int64(freezeTime), 0).Format("2006-01-02 15:04:05 Asia/Kolkata"),
-		EndTimeString:        time.Unix(int64(endTime), 0).Format("2006-01-02 15:04:05 Asia/Kolkata"),
-		UnfreezeTimeString:   time.Unix(int64(unfreezeTime), 0).Format("2006-01-02 15:04:05 Asia/Kolkata"),
-		DeactivateTimeString: time.Unix(int64(deactivateTime), 0).Format("2006-01-02 15:04:05 Asia/Kolkata"),
+		ActivateTimeString:   FormatContestTime(activateTime, loc),
+		StartTimeString:      FormatContestTime(startTime, loc),
+		FreezeTimeString:     FormatContestTime(freezeTime, loc),
+		EndTimeString:        FormatContestTime(endTime, loc),
+		UnfreezeTimeString:   FormatContestTime(unfreezeTime, loc),
+		DeactivateTimeString: FormatContestTime(deactivateTime, loc),
 		Enabled:              1,
 		Public:               0,
 
@@ -41,6 +51,65 @@ func BuildNewContest(name string, shortName string, durationHours int) (contest
 	}
 }
 
+// Parse contest start time (e.g. "2019-05-21 12:00" or "2019-05-21 12:00:00") in the given timezone
+func ParseContestStartTime(startTime string, loc *time.Location) (t time.Time, err error) {
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02T15:04:05", "2006-01-02T15:04"} {
+		if t, err = time.ParseInLocation(layout, startTime, loc); err == nil {
+			return t, nil
+		}
+	}
+	return t, fmt.Errorf("start time %s should be of the form YYYY-MM-DD HH:MM[:SS]", startTime)
+}
+
+// Find the timezone a contest was created in from its *_string columns (falls back to loc)
+func GetContestLocation(contest Contest, loc *time.Location) *time.Location {
+	parts := strings.Fields(contest.StartTimeString)
+	if len(parts) == 3 {
+		if contestLoc, err := time.LoadLocation(parts[2]); err == nil {
+			return contestLoc
+		}
+	}
+	return loc
+}
+
+// Format a unix timestamp the way DOMJudge expects it in the *_string columns of contest table,
+// i.e. wall clock time in the timezone followed by its IANA name ("2019-05-21 12:00:00 Asia/Kolkata")
+func FormatContestTime(t float64, loc *time.Location) string {
+	return time.Unix(int64(t), 0).In(loc).Format("2006-01-02 15:04:05 ") + loc.String()
+}
+
+// Refresh all *_string columns of a contest from its float time columns
+func SetContestTimeStrings(contest *Contest, loc *time.Location) {
+	contest.ActivateTimeString = FormatContestTime(contest.ActivateTime, loc)
+	contest.StartTimeString = FormatContestTime(contest.StartTime, loc)
+	contest.FreezeTimeString = FormatContestTime(contest.FreezeTime, loc)
+	contest.EndTimeString = FormatContestTime(contest.EndTime, loc)
+	contest.UnfreezeTimeString = FormatContestTime(contest.UnfreezeTime, loc)
+	contest.DeactivateTimeString = FormatContestTime(contest.DeactivateTime, loc)
+}
+
+// Check that contest times are ordered: activate <= start <= freeze <= end <= unfreeze <= deactivate
+func ValidateContestTimes(contest Contest) (err error) {
+	times := []struct {
+		name string
+		t    float64
+	}{
+		{"activatetime", contest.ActivateTime},
+		{"starttime", contest.StartTime},
+		{"freezetime", contest.FreezeTime},
+		{"endtime", contest.EndTime},
+		{"unfreezetime", contest.UnfreezeTime},
+		{"deactivatetime", contest.DeactivateTime},
+	}
+	for i := 1; i < len(times); i++ {
+		if times[i-1].t > times[i].t {
+			return PrintErr("CONTEST_TIMES_ORDER_ERR", fmt.Sprintf("contestshortname: %s, %s (%s) is after %s (%s)",
+				contest.ShortName, times[i-1].name, time.Unix(int64(times[i-1].t), 0), times[i].name, time.Unix(int64(times[i].t), 0)))
+		}
+	}
+	return nil
+}
+
 // Get contest from mysql db by short name
 func GetContestByShortName(contestShortName string, config *Config) (contest Contest, err error) {
 	// Get contest with greatest ID
@@ -54,35 +123,34 @@ func GetContestByShortName(contestShortName string, config *Config) (contest Con
 	return contest, nil
 }
 
-// Create a new contest in contests table
-// ContestId (cid column) is set by reading the latest contest from contest table and incrementing it by 1
-func CreateContest(newContest Contest, config *Config) (err error) {
-	var contests []Contest
-	// Get contest with greatest ID
-	if err = config.Db.Table("contest").Limit(1).Order("cid desc").Find(&contests).Error; err != nil {
-		return PrintErr("READ_LATEST_CONTEST_ERR", fmt.Sprintf("%v", err))
-	}
-	if len(contests) == 0 {
-		return PrintErr("READ_LATEST_CONTEST_ERR", "No contests read")
+// Get all contests, latest first
+func GetContests(config *Config) (contests []Contest, err error) {
+	if err = config.Db.Table("contest").Order("starttime DESC, cid DESC").Find(&contests).Error; err != nil {
+		return nil, PrintErr("READ_CONTESTS_ERR", fmt.Sprintf("%v", err))
 	}
+	return contests, nil
+}
 
+// Create a new contest in contests table along with its problems in contestproblem table
+// ContestId (cid column) is allocated by mysql AUTO_INCREMENT and read back after insert, so that
+// concurrent creates (by this service or DOMJudge UI) never share a cid
+func CreateContest(newContest Contest, config *Config) (err error) {
 	// Add index to email column of user table
-	rows, err := config.Db.Raw("SELECT COUNT(1) IndexIsThere FROM INFORMATION_SCHEMA.STATISTICS WHERE table_schema=DATABASE() AND table_name='user' AND index_name='user_email';").Rows()
-	if err != nil {
+	var result int
+	if err = config.Db.Raw("SELECT COUNT(1) IndexIsThere FROM INFORMATION_SCHEMA.STATISTICS WHERE table_schema=DATABASE() AND table_name='user' AND index_name='user_email';").Row().Scan(&result); err != nil {
 		return PrintErr("READ_EMAILINDEX_ERR", fmt.Sprintf("contestshortname: %s): %v", newContest.ShortName, err))
 	}
-	defer rows.Close()
-	var result int
-	for rows.Next() {
-		rows.Scan(&result)
-		if result == 0 {
-			log.Printf("EMAILINDEX: No email index found for user table, creating one: %d\n", result)
-			if err = config.Db.Exec("CREATE INDEX user_email ON user (email) USING BTREE;").Error; err != nil {
-				return PrintErr("CREATE_EMAIL_INDEX_ERROR", fmt.Sprintf("Error creating index on email column of user table: %v", err))
-			}
-		} else {
-			log.Printf("EMAILINDEX_ALREADYPRESENT\n")
+	if result == 0 {
+		log.Printf("EMAILINDEX: No email index found for user table, creating one: %d\n", result)
+		if err = config.Db.Exec("CREATE INDEX user_email ON user (email) USING BTREE;").Error; err != nil {
+			return PrintErr("CREATE_EMAIL_INDEX_ERROR", fmt.Sprintf("Error creating index on email column of user table: %v", err))
 		}
+	} else {
+		log.Printf("EMAILINDEX_ALREADYPRESENT\n")
+	}
+
+	if err = ValidateContestTimes(newContest); err != nil {
+		return err
 	}
 
 	// Check if contest already created
@@ -95,18 +163,229 @@ func CreateContest(newContest Contest, config *Config) (err error) {
 		return nil
 	}
 
-	newCid := contests[0].Cid + 1
-	newContest.Cid = newCid
-	PrintVal("LATEST_CONTEST", contests)
+	newContest.Cid = 0
 	PrintVal("NEW_CONTEST", newContest)
-	if err = config.Db.Table("contest").Create(newContest).Error; err != nil {
+	tx := config.Db.Begin()
+	if err = tx.Error; err != nil {
+		return PrintErr("TXN_OBJ_ERR", fmt.Sprintf("%v", err))
+	}
+	if err = tx.Table("contest").Create(&newContest).Error; err != nil {
+		tx.Rollback()
 		return PrintErr("INSERT_CONTEST_TABLE_ERR", fmt.Sprintf("Error inserting %s into 'contest' table: %v", newContest.ShortName, err))
 	}
+	log.Printf("NEW_CONTEST_ID: (shortname: %s, cid: %d)\n", newContest.ShortName, newContest.Cid)
+	if err = AddContestProblems(newContest.Cid, newContest.Problems, tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err = tx.Commit().Error; err != nil {
+		return PrintErr("TX_COMMIT_ERR", fmt.Sprintf("Error inserting %s into tables as txn: %v", newContest.ShortName, err))
+	}
+	config.Audit.Record(AuditEntry{Action: "CREATE_CONTEST", Contest: newContest.ShortName, Cid: newContest.Cid})
+	return nil
+}
+
+// Create a new contest by copying problem set, freeze/end offsets and public/enabled flags of an existing contest
+// Teams, users and submissions are not copied. Contest name defaults to the source contest name
+func CloneContest(fromShortName string, name string, shortName string, startAt time.Time, loc *time.Location, config *Config) (err error) {
+	source, err := GetContestByShortName(fromShortName, config)
+	if err != nil {
+		return err
+	}
+	if source.Name == "" || source.Cid == 0 {
+		return PrintErr("CONTEST_NOT_FOUND", fmt.Sprintf("contestshortname: %s", fromShortName))
+	}
+	PrintVal("SOURCE_CONTEST", source)
+	problems, err := GetContestProblems(source.Cid, config.Db)
+	if err != nil {
+		return err
+	}
+	if name == "" {
+		name = source.Name
+	}
+
+	newContest := BuildNewContest(name, shortName, 0, startAt, 0, loc)
+	newContest.FreezeTime = newContest.StartTime + (source.FreezeTime - source.StartTime)
+	newContest.EndTime = newContest.StartTime + (source.EndTime - source.StartTime)
+	newContest.UnfreezeTime = newContest.EndTime + (source.UnfreezeTime - source.EndTime)
+	newContest.DeactivateTime = newContest.StartTime + (source.DeactivateTime - source.StartTime)
+	SetContestTimeStrings(&newContest, loc)
+	newContest.Enabled = source.Enabled
+	newContest.Public = source.Public
+	newContest.DurationHours = int((source.EndTime - source.StartTime) / 3600)
+	for i := range problems {
+		problems[i].Cid = 0
+	}
+	newContest.Problems = problems
+
+	return CreateContest(newContest, config)
+}
+
+// Update all time columns (float and *_string) of a contest in contest table
+func UpdateContestTimes(contest Contest, config *Config) (err error) {
+	SetContestTimeStrings(&contest, GetContestLocation(contest, config.Location))
+	if err = ValidateContestTimes(contest); err != nil {
+		return err
+	}
+	PrintVal("UPDATED_CONTEST", contest)
+	if err = config.Db.Table("contest").Where("cid = ?", contest.Cid).Updates(map[string]interface{}{
+		"activatetime":          contest.ActivateTime,
+		"starttime":             contest.StartTime,
+		"freezetime":            contest.FreezeTime,
+		"endtime":               contest.EndTime,
+		"unfreezetime":          contest.UnfreezeTime,
+		"deactivatetime":        contest.DeactivateTime,
+		"activatetime_string":   contest.ActivateTimeString,
+		"starttime_string":      contest.StartTimeString,
+		"freezetime_string":     contest.FreezeTimeString,
+		"endtime_string":        contest.EndTimeString,
+		"unfreezetime_string":   contest.UnfreezeTimeString,
+		"deactivatetime_string": contest.DeactivateTimeString,
+	}).Error; err != nil {
+		return PrintErr("UPDATE_CONTEST_TIMES_ERR", fmt.Sprintf("Error updating %s in 'contest' table: %v", contest.ShortName, err))
+	}
+	return nil
+}
+
+// Start, end, freeze or unfreeze a contest right now
+// START_CONTEST: starttime is set to now, freeze/end/unfreeze times are moved by the same amount and activatetime
+// is moved back to now if it is later, so that teams see the contest right away
+// (endtime is set to starttime + durationHours if durationHours is non zero)
+// END_CONTEST: endtime is set to now
+// FREEZE_CONTEST: freezetime is set to now
+// UNFREEZE_CONTEST: unfreezetime is set to now
+// Changes which break activate <= start <= freeze <= end <= unfreeze <= deactivate are refused
+func ChangeContestState(contestShortName string, op string, durationHours int, config *Config) (err error) {
+	contest, err := GetContestByShortName(contestShortName, config)
+	if err != nil {
+		return err
+	}
+	if contest.Name == "" || contest.Cid == 0 {
+		return PrintErr("CONTEST_NOT_FOUND", fmt.Sprintf("contestshortname: %s", contestShortName))
+	}
+	PrintVal("CONTEST", contest)
+
+	now := float64(time.Now().Unix())
+	switch op {
+	case "START_CONTEST":
+		delta := now - contest.StartTime
+		endTime := contest.EndTime + delta
+		if durationHours > 0 {
+			endTime = now + float64(durationHours*3600)
+		}
+		contest.StartTime = now
+		if contest.ActivateTime > now {
+			contest.ActivateTime = now
+		}
+		contest.FreezeTime += delta
+		contest.UnfreezeTime += endTime - contest.EndTime
+		contest.EndTime = endTime
+	case "END_CONTEST":
+		contest.EndTime = now
+	case "FREEZE_CONTEST":
+		contest.FreezeTime = now
+	case "UNFREEZE_CONTEST":
+		contest.UnfreezeTime = now
+	default:
+		return PrintErr("UNKNOWN_CONTEST_STATE_OP", op)
+	}
+
+	if err = UpdateContestTimes(contest, config); err != nil {
+		return err
+	}
+	log.Printf("%s_SUCCESS: (shortname: %s, starttime: %s, freezetime: %s, endtime: %s, unfreezetime: %s)\n", op, contest.ShortName,
+		contest.StartTimeString, contest.FreezeTimeString, contest.EndTimeString, contest.UnfreezeTimeString)
+	return nil
+}
+
+// Rows of a contest besides its teams, deleted children first so that none are removed by DOMJudge's ON DELETE CASCADE
+// without being journaled and counted. Submission tables are kept with keep-submissions
+var contestDataTables = []struct {
+	Table      string
+	Where      string
+	Submission bool
+}{
+	{"judging_run_output", "runid IN (SELECT runid FROM judging_run WHERE judgingid IN (SELECT judgingid FROM judging WHERE cid = ?))", true},
+	{"judging_run", "judgingid IN (SELECT judgingid FROM judging WHERE cid = ?)", true},
+	{"judging", "cid = ?", true},
+	{"balloon", "submitid IN (SELECT submitid FROM submission WHERE cid = ?)", false},
+	{"submission_file", "submitid IN (SELECT submitid FROM submission WHERE cid = ?)", true},
+	{"submission", "cid = ?", true},
+	{"scorecache", "cid = ?", false},
+	{"rankcache", "cid = ?", false},
+	{"team_unread", "mesgid IN (SELECT clarid FROM clarification WHERE cid = ?)", false},
+	{"clarification", "cid = ?", false},
+	{"event", "cid = ?", false},
+}
+
+// Rows of a table to be journaled and deleted, selected by Where with Args
+type dataTableRows struct {
+	Table string
+	Where string
+	Args  []interface{}
+}
+
+// Rows of a team besides its user and contestteam rows (only those of contest contestId unless it is 0: all rows
+// DOMJudge's ON DELETE CASCADE removes with the team), children first like contestDataTables
+func teamDataTables(teamId int, contestId int) []dataTableRows {
+	submissions, submissionArgs := "teamid = ?", []interface{}{teamId}
+	clarifications, clarificationArgs := "sender = ? OR recipient = ?", []interface{}{teamId, teamId}
+	// Unread marks of the team itself, and of other teams for the clarifications deleted below
+	unread, unreadArgs := "teamid = ?", []interface{}{teamId}
+	if contestId != 0 {
+		submissions, submissionArgs = "teamid = ? AND cid = ?", []interface{}{teamId, contestId}
+		clarifications, clarificationArgs = "(sender = ? OR recipient = ?) AND cid = ?", []interface{}{teamId, teamId, contestId}
+		unread, unreadArgs = "teamid = ? AND mesgid IN (SELECT clarid FROM clarification WHERE cid = ?)", []interface{}{teamId, contestId}
+	}
+	submitIds := "submitid IN (SELECT submitid FROM submission WHERE " + submissions + ")"
+	judgingIds := "judgingid IN (SELECT judgingid FROM judging WHERE " + submitIds + ")"
+	return []dataTableRows{
+		{"judging_run_output", "runid IN (SELECT runid FROM judging_run WHERE " + judgingIds + ")", submissionArgs},
+		{"judging_run", judgingIds, submissionArgs},
+		{"judging", submitIds, submissionArgs},
+		{"balloon", submitIds, submissionArgs},
+		{"submission_file", submitIds, submissionArgs},
+		{"submission", submissions, submissionArgs},
+		{"scorecache", submissions, submissionArgs},
+		{"rankcache", submissions, submissionArgs},
+		{"team_unread", unread + " OR mesgid IN (SELECT clarid FROM clarification WHERE " + clarifications + ")",
+			append(append([]interface{}{}, unreadArgs...), clarificationArgs...)},
+		{"clarification", clarifications, clarificationArgs},
+	}
+}
+
+// Save rows of each table to the undo journal and delete them in txn tx, skipping tables which are not in this
+// DOMJudge version, number of rows deleted from each table is added to counts (desc describes the rows in logs)
+func deleteDataRows(rows []dataTableRows, desc string, counts map[string]int64, tx *gorm.DB, config *Config) (err error) {
+	tables, err := getTableNames(tx)
+	if err != nil {
+		return err
+	}
+	for _, t := range rows {
+		if !tables[t.Table] {
+			log.Printf("SKIP_MISSING_TABLE: %s is not in this DOMJudge version\n", t.Table)
+			continue
+		}
+		if err = config.Journal.Snapshot(tx, t.Table, t.Where, t.Args...); err != nil {
+			return err
+		}
+		res := tx.Exec(fmt.Sprintf("DELETE FROM `%s` WHERE %s", t.Table, t.Where), t.Args...)
+		if err = res.Error; err != nil {
+			return PrintErr("DELETE_DATA_ERR", fmt.Sprintf("Error deleting %s rows (%s): %v", t.Table, desc, err))
+		}
+		counts[t.Table] += res.RowsAffected
+		log.Printf("DELETE_%s_SUCCESS: (%s, rows: %d)\n", strings.ToUpper(t.Table), desc, res.RowsAffected)
+	}
 	return nil
 }
 
-// Delete contest by its short-name with all its users, teams and submissions
-func DeleteContestFull(contestShortName string, config *Config) (err error) {
+// Delete contest by its short-name with all its users, teams, submissions (with their files), judgings, balloons,
+// scoreboard caches, clarifications and events in one txn and print the outcome for each team and the number of rows
+// deleted from each table
+// With keepSubmissions the contest is archived instead: the contest, its problems, teams, submissions and judgings are
+// kept and only the users (logins) of its teams, balloons, scoreboard caches, clarifications and events are deleted
+// If any team cannot be deleted, the txn is rolled back and nothing (not even the other teams) is deleted
+func DeleteContestFull(contestShortName string, keepSubmissions bool, config *Config) (err error) {
 	if contestShortName == "" {
 		return PrintErr("DELETE_EMPTY_SHORT_NAME", "")
 	}
@@ -122,86 +401,354 @@ func DeleteContestFull(contestShortName string, config *Config) (err error) {
 	PrintVal("CONTEST", contests)
 	contestId := contests[0].Cid
 
+	tx := config.Db.Begin()
+	// Rows journaled in a txn which is rolled back were never deleted, they are dropped from the journal
+	rollback := func() {
+		tx.Rollback()
+		config.Journal.Discard(tx)
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			rollback()
+		}
+	}()
+	if err = tx.Error; err != nil {
+		return PrintErr("TXN_OBJ_ERR", fmt.Sprintf("%v", err))
+	}
+	if !keepSubmissions {
+		if err = config.Journal.Snapshot(tx, "contest", "cid = ?", contestId); err != nil {
+			rollback()
+			return err
+		}
+		if err = config.Journal.Snapshot(tx, "contestproblem", "cid = ?", contestId); err != nil {
+			rollback()
+			return err
+		}
+	}
+
+	// Delete submissions, judgings, scoreboard caches, clarifications and events of the contest
+	counts := make(map[string]int64)
+	var rows []dataTableRows
+	for _, t := range contestDataTables {
+		if keepSubmissions && t.Submission {
+			log.Printf("KEEP_SUBMISSIONS: keeping %s rows of %s\n", t.Table, contestShortName)
+			continue
+		}
+		rows = append(rows, dataTableRows{t.Table, t.Where, []interface{}{contestId}})
+	}
+	if err = deleteDataRows(rows, "contestshortname: "+contestShortName, counts, tx, config); err != nil {
+		rollback()
+		return err
+	}
+
 	// Find teams which have been registered for the contest
-	rows, err := config.Db.Table("contestteam").Raw("SELECT teamid from contestteam WHERE cid = ?", contestId).Rows()
-	if err != nil {
+	var teamIds []int
+	if err = tx.Table("contestteam").Where("cid = ?", contestId).Pluck("teamid", &teamIds).Error; err != nil {
+		rollback()
 		return PrintErr("READ_CONTESTTEAMS_ERR", fmt.Sprintf("contestshortname: %s, contestid: %d): %v", contestShortName, contestId, err))
 	}
-	defer rows.Close()
-	var teamId int
-	for rows.Next() {
-		rows.Scan(&teamId)
+	audit := AuditEntry{Action: "DELETE_CONTEST", Contest: contestShortName, Cid: contestId}
+	if keepSubmissions {
+		audit.Action = "ARCHIVE_CONTEST"
+	}
+	results := make([]teamDeleteResult, len(teamIds))
+	failed := 0
+	for i, teamId := range teamIds {
+		results[i] = teamDeleteResult{TeamId: teamId, Status: "NOT_ATTEMPTED"}
+		if failed > 0 {
+			continue
+		}
+		if keepSubmissions {
+			log.Printf("DELETE_TEAM_USERS: Deleting users of teamId: %v\n", teamId)
+			users, err := DeleteTeamUsersInTx(teamId, contestId, counts, tx, config)
+			results[i].Status = "KEPT"
+			if err != nil {
+				results[i].Status, results[i].Err = "FAILED", err
+				failed++
+			} else if len(users) > 0 {
+				results[i].Email, results[i].Username, results[i].Status = users[0].Email, users[0].Username, "USERS_DELETED"
+				audit.TeamIds = append(audit.TeamIds, teamId)
+				for _, user := range users {
+					audit.UserIds = append(audit.UserIds, user.UserId)
+					audit.Emails = append(audit.Emails, user.Email)
+				}
+			}
+			continue
+		}
 		log.Printf("DELETE_TEAMID: Deleting teamId: %v\n", teamId)
-		DeleteUser("userid", teamId, contestId, config)
+		user, deleted, err := DeleteUserInTx("teamid", teamId, contestId, counts, tx, config)
+		results[i].Email, results[i].Username = user.Email, user.Username
+		if err != nil && strings.Contains(err.Error(), "NO_USER_TO_DELETE") {
+			// Teams without a user (e.g. created in DOMJudge UI) are only removed from the contest, like teams
+			// which are registered for other contests
+			if err = config.Journal.Snapshot(tx, "contestteam", "cid = ? AND teamid = ?", contestId, teamId); err == nil {
+				res := tx.Exec("DELETE FROM contestteam WHERE cid = ? AND teamid = ?", contestId, teamId)
+				err = res.Error
+				counts["contestteam"] += res.RowsAffected
+			}
+			results[i].Status = "UNLINKED"
+		} else if err == nil {
+			results[i].Status = "DELETED"
+			if !deleted {
+				results[i].Status = "UNLINKED"
+			}
+			audit.TeamIds = append(audit.TeamIds, user.TeamId)
+			audit.UserIds = append(audit.UserIds, user.UserId)
+			audit.Emails = append(audit.Emails, user.Email)
+		}
+		if err != nil {
+			results[i].Status, results[i].Err = "FAILED", err
+			failed++
+		}
+	}
+	if failed > 0 {
+		// Stop before deleting the contest and undo deletion of all teams
+		rollback()
+		for i := range results {
+			if results[i].Status == "DELETED" || results[i].Status == "UNLINKED" || results[i].Status == "USERS_DELETED" {
+				results[i].Status = "ROLLED_BACK"
+			}
+		}
+		printTeamDeleteResults(results)
+		return PrintErr("DELETE_CONTEST_TEAMS_ERR", fmt.Sprintf("failed to delete a team of %s, nothing was deleted", contestShortName))
 	}
 
-	log.Printf("DELETE_FROM_CONTEST_TABLE: Deleting %s from 'contest' table\n", contestShortName)
-	if err = config.Db.Table("contest").Delete(Contest{}, "shortname = ?", contestShortName).Error; err != nil {
-		return PrintErr("DELETE_FROM_CONTEST_TABLE_ERR", fmt.Sprintf("Error deleting %s from 'contest' table: %v", contestShortName, err))
+	if !keepSubmissions {
+		log.Printf("DELETE_FROM_CONTEST_TABLE: Deleting %s from 'contest' table\n", contestShortName)
+		res := tx.Exec("DELETE FROM contestproblem WHERE cid = ?", contestId)
+		if err = res.Error; err != nil {
+			rollback()
+			return PrintErr("DELETE_CONTESTPROBLEM_ERR", fmt.Sprintf("Error deleting %s from 'contestproblem' table: %v", contestShortName, err))
+		}
+		counts["contestproblem"] = res.RowsAffected
+		res = tx.Table("contest").Delete(Contest{}, "cid = ?", contestId)
+		if err = res.Error; err != nil {
+			rollback()
+			return PrintErr("DELETE_FROM_CONTEST_TABLE_ERR", fmt.Sprintf("Error deleting %s from 'contest' table: %v", contestShortName, err))
+		}
+		counts["contest"] = res.RowsAffected
 	}
+	if err = config.Journal.CommitTx(tx); err != nil {
+		return PrintErr("TX_COMMIT_ERR", fmt.Sprintf("Error deleting %s from tables as txn: %v", contestShortName, err))
+	}
+	config.Audit.Record(audit)
 
+	printTeamDeleteResults(results)
+	fmt.Printf("table\tdeleted\n")
+	for _, t := range contestDataTables {
+		fmt.Printf("%s\t%d\n", t.Table, counts[t.Table])
+	}
+	for _, table := range []string{"contestteam", "userrole", "user", "team", "contestproblem", "contest"} {
+		fmt.Printf("%s\t%d\n", table, counts[table])
+	}
 	return nil
 }
 
+// Delete the users (logins) of a team with their userrole rows in txn tx, keeping the team with its submissions and
+// judgings (DELETE_CONTEST with keep-submissions), number of rows deleted from each table is added to counts
+// Teams which are registered for other contests keep their users, users is then empty
+func DeleteTeamUsersInTx(teamId int, contestId int, counts map[string]int64, tx *gorm.DB, config *Config) (users []User, err error) {
+	var otherContests int
+	if err = tx.Table("contestteam").Where("teamid = ? AND cid <> ?", teamId, contestId).Count(&otherContests).Error; err != nil {
+		return nil, PrintErr("READ_CONTESTTEAM_ERR", fmt.Sprintf("teamid: %d): %v", teamId, err))
+	}
+	if otherContests > 0 {
+		log.Printf("TEAM_IN_OTHER_CONTESTS: (teamid: %d, contests: %d) users kept\n", teamId, otherContests)
+		return nil, nil
+	}
+	if err = tx.Table("user").Where("teamid = ?", teamId).Find(&users).Error; err != nil {
+		return nil, PrintErr("READ_TEAM_USERS_ERR", fmt.Sprintf("teamid: %d): %v", teamId, err))
+	}
+	if len(users) == 0 {
+		return nil, nil
+	}
+	desc := fmt.Sprintf("teamid: %d", teamId)
+	// DOMJudge versions which record the submitting user would cascade (or refuse) the user delete to the kept
+	// submissions, they keep the team only
+	columns, err := getColumnNames("submission", tx)
+	if err != nil {
+		return nil, err
+	}
+	if columns["userid"] {
+		if err = tx.Exec("UPDATE submission SET userid = NULL WHERE userid IN (SELECT userid FROM user WHERE teamid = ?)", teamId).Error; err != nil {
+			return nil, PrintErr("UNSET_SUBMISSION_USER_ERR", fmt.Sprintf("(%s): %v", desc, err))
+		}
+	}
+	rows := []dataTableRows{
+		{"userrole", "userid IN (SELECT userid FROM user WHERE teamid = ?)", []interface{}{teamId}},
+		{"user", "teamid = ?", []interface{}{teamId}},
+	}
+	if err = deleteDataRows(rows, desc, counts, tx, config); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// Names of the columns of a table of the database
+func getColumnNames(table string, db *gorm.DB) (columns map[string]bool, err error) {
+	var names []string
+	if err = db.Raw("SELECT column_name FROM INFORMATION_SCHEMA.COLUMNS WHERE table_schema = DATABASE() AND table_name = ?", table).Pluck("column_name", &names).Error; err != nil {
+		return nil, PrintErr("READ_COLUMNS_ERR", fmt.Sprintf("table %s: %v", table, err))
+	}
+	columns = make(map[string]bool)
+	for _, name := range names {
+		columns[strings.ToLower(name)] = true
+	}
+	return columns, nil
+}
+
+// Names of the tables of the database, tables differ between DOMJudge versions (e.g. judging_run_output)
+func getTableNames(db *gorm.DB) (tables map[string]bool, err error) {
+	var names []string
+	if err = db.Raw("SELECT table_name FROM INFORMATION_SCHEMA.TABLES WHERE table_schema = DATABASE()").Pluck("table_name", &names).Error; err != nil {
+		return nil, PrintErr("READ_TABLES_ERR", fmt.Sprintf("%v", err))
+	}
+	tables = make(map[string]bool)
+	for _, name := range names {
+		tables[strings.ToLower(name)] = true
+	}
+	return tables, nil
+}
+
+// Outcome of deleting a team of a contest
+type teamDeleteResult struct {
+	TeamId   int
+	Email    string
+	Username string
+	Status   string
+	Err      error
+}
+
+// Print outcome of deleting each team as TSV to stdout
+func printTeamDeleteResults(results []teamDeleteResult) {
+	fmt.Printf("teamid\temail\tusername\tstatus\terror\n")
+	for _, result := range results {
+		errStr := ""
+		if result.Err != nil {
+			errStr = strings.TrimSpace(result.Err.Error())
+		}
+		fmt.Printf("%d\t%s\t%s\t%s\t%s\n", result.TeamId, result.Email, result.Username, result.Status, errStr)
+	}
+}
+
 // Fetch contest results from database
-func FetchResults(contestShortName string, config *Config) (users []*User, teamScores []*TeamScore, err error) {
+// Teams are ordered like DOMJudge scoreboard (from rankcache), each with a score per problem of the contest (from
+// scorecache) in the order of problems (contestproblem shortname). Problem time is minutes from contest start to
+// the correct submission like on DOMJudge scoreboard
+func FetchResults(contestShortName string, config *Config) (users []*User, teamScores []*TeamScore, problems []ContestProblem, err error) {
 	curContest, err := GetContestByShortName(contestShortName, config)
 	if err != nil {
-		return nil, nil, PrintErr("CONTEST_FETCH_ERR", fmt.Sprintf("contestshortname: %s): %v", contestShortName, err))
+		return nil, nil, nil, PrintErr("CONTEST_FETCH_ERR", fmt.Sprintf("contestshortname: %s): %v", contestShortName, err))
 	}
 	if curContest.Name == "" || curContest.Cid == 0 {
-		return nil, nil, PrintErr("CONTEST_NOT_FOUND", fmt.Sprintf("contestshortname: %s): %v", contestShortName, err))
+		return nil, nil, nil, PrintErr("CONTEST_NOT_FOUND", fmt.Sprintf("contestshortname: %s): %v", contestShortName, err))
 	}
 
 	sqlQuery := `SELECT cid, teamid, points_restricted, totaltime_restricted FROM rankcache WHERE cid = ? ORDER BY points_restricted DESC, totaltime_restricted ASC`
 	rows, err := config.Db.Raw(sqlQuery, curContest.Cid).Rows()
 	if err != nil {
-		return nil, nil, PrintErr("SCOREBOARD_GET_ERR", fmt.Sprintf("contestshortname: %s): %v", contestShortName, err))
+		return nil, nil, nil, PrintErr("SCOREBOARD_GET_ERR", fmt.Sprintf("contestshortname: %s): %v", contestShortName, err))
 	}
 	defer rows.Close()
 
-	users = make([]*User, 0)
-	teamScores = make([]*TeamScore, 0)
+	scores := make([]*TeamScore, 0)
 	log.Printf("TEAM_SCORE_FETCH: (contestid %d)\n", curContest.Cid)
 	for rows.Next() {
 		teamScore := new(TeamScore)
 		err := rows.Scan(&teamScore.Cid, &teamScore.TeamId, &teamScore.Points, &teamScore.TimeTaken)
 		if err != nil {
-			return nil, nil, PrintErr("FETCH_SCORE_ERR", fmt.Sprintf("failed to fetch score (teamId %d): %v", teamScore.TeamId, err))
+			return nil, nil, nil, PrintErr("FETCH_SCORE_ERR", fmt.Sprintf("failed to fetch score (teamId %d): %v", teamScore.TeamId, err))
 		}
 		PrintVal("TEAM_SCORE", teamScore)
-		user, err := GetUserById("userid", teamScore.TeamId, false, config.Db)
-		if err != nil {
-			return nil, nil, PrintErr("FETCH_USER_BY_ID_ERR", fmt.Sprintf("failed to fetch user (teamId %d): %v", teamScore.TeamId, err))
+		scores = append(scores, teamScore)
+	}
+	rows.Close()
+
+	problems, err = GetContestProblems(curContest.Cid, config.Db)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	problemScores, err := fetchProblemScores(curContest, config)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	teamIds := make([]int, len(scores))
+	for i, teamScore := range scores {
+		teamIds[i] = teamScore.TeamId
+	}
+	teamUsers, err := GetTeamUsers(teamIds, config)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	users = make([]*User, 0)
+	teamScores = make([]*TeamScore, 0)
+	for _, teamScore := range scores {
+		user, ok := teamUsers[teamScore.TeamId]
+		if !ok {
+			continue
+		}
+		teamScore.Problems = make([]ProblemScore, len(problems))
+		for i, problem := range problems {
+			teamScore.Problems[i] = problemScores[teamScore.TeamId][problem.ProbId]
+			teamScore.Problems[i].ShortName = problem.ShortName
+			teamScore.Problems[i].ProbId = problem.ProbId
 		}
 		users = append(users, user)
 		teamScores = append(teamScores, teamScore)
 	}
 
-	return users, teamScores, nil
+	return users, teamScores, problems, nil
 }
 
-// Fetch contest results and export as TSV
-func ExportResultsTSV(contestShortName string, config *Config) (err error) {
-	users, teamScores, err := FetchResults(contestShortName, config)
-	if err != nil {
-		return err
+// Get user of each team (teamid -> user), teams without a user (e.g. jury teams) are skipped
+func GetTeamUsers(teamIds []int, config *Config) (teamUsers map[int]*User, err error) {
+	teamUsers = make(map[int]*User)
+	for _, teamId := range teamIds {
+		if _, ok := teamUsers[teamId]; ok {
+			continue
+		}
+		user, err := GetUserById("teamid", teamId, false, config.Db)
+		if err != nil && strings.Contains(err.Error(), "USER_NOT_FOUND") {
+			log.Printf("TEAM_WITHOUT_USER: (teamId %d) no user found for team, skipping ...\n", teamId)
+			continue
+		}
+		if err != nil {
+			return nil, PrintErr("FETCH_USER_BY_ID_ERR", fmt.Sprintf("failed to fetch user (teamId %d): %v", teamId, err))
+		}
+		teamUsers[teamId] = user
 	}
-	outputFilename := config.CliArgs.ResultsFile
-	outputFile, err := os.OpenFile(outputFilename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	return teamUsers, nil
+}
+
+// Fetch score of every team for every problem of a contest from scorecache (teamid -> probid -> score)
+func fetchProblemScores(contest Contest, config *Config) (problemScores map[int]map[int]ProblemScore, err error) {
+	sqlQuery := `SELECT teamid, probid, submissions_restricted, pending_restricted, solvetime_restricted, is_correct_restricted FROM scorecache WHERE cid = ?`
+	rows, err := config.Db.Raw(sqlQuery, contest.Cid).Rows()
 	if err != nil {
-		return PrintErr("FILE_WOPEN_ERR", fmt.Sprintf("%s: %v", outputFilename, err))
+		return nil, PrintErr("SCORECACHE_GET_ERR", fmt.Sprintf("contestshortname: %s): %v", contest.ShortName, err))
 	}
-	defer outputFile.Close()
-	text := fmt.Sprintf("email\tusername\tuserid\tcontestid\tpoints\ttotaltime\n")
-	if _, err = outputFile.WriteString(text); err != nil {
-		return PrintErr("RESULTS_HEADER_WRITE_ERR", fmt.Sprintf("failed to print header details to %s: %v\n", outputFilename, err))
-	}
-	for i := 0; i < len(users); i++ {
-		line := fmt.Sprintf("%s\t%s\t%d\t%d\t%d\t%d\n", users[i].Email, users[i].Name, users[i].UserId, teamScores[i].Cid, teamScores[i].Points, teamScores[i].TimeTaken)
-		if _, err = outputFile.WriteString(line); err != nil {
-			return PrintErr("RESULTS_WRITE_ERR", fmt.Sprintf("failed to print results to %s: %v\n", outputFilename, err))
+	defer rows.Close()
+
+	problemScores = make(map[int]map[int]ProblemScore)
+	for rows.Next() {
+		var teamId, probId int
+		var solveTime float64
+		var problemScore ProblemScore
+		if err = rows.Scan(&teamId, &probId, &problemScore.Submissions, &problemScore.Pending, &solveTime, &problemScore.Solved); err != nil {
+			return nil, PrintErr("FETCH_SCORECACHE_ERR", fmt.Sprintf("contestshortname: %s): %v", contest.ShortName, err))
+		}
+		if problemScore.Solved {
+			problemScore.Time = int((solveTime - contest.StartTime) / 60)
+		}
+		if problemScores[teamId] == nil {
+			problemScores[teamId] = make(map[int]ProblemScore)
 		}
+		problemScores[teamId][probId] = problemScore
 	}
-	return nil
+	if err = rows.Err(); err != nil {
+		return nil, PrintErr("FETCH_SCORECACHE_ERR", fmt.Sprintf("contestshortname: %s): %v", contest.ShortName, err))
+	}
+	return problemScores, nil
 }
@@ -0,0 +1,69 @@
+#!/bin/bash
+# Checks that concurrent ADD_USERS runs never share team/user ids
+# Starts a throwaway MariaDB container with the DOMJudge tables used by domjudge-interview, creates a contest,
+# runs 2 ADD_USERS processes (each with --concurrency 8) in parallel and verifies all ids are distinct
+set -euo pipefail
+
+BIN=${BIN:-$GOPATH/bin/domjudge-interview}
+NAME=dj-parallel-check
+PORT=${PORT:-13306}
+USERS_PER_RUN=${USERS_PER_RUN:-100}
+WORKDIR=$(mktemp -d)
+
+cleanup() { docker rm -f $NAME >/dev/null 2>&1 || true; rm -rf "$WORKDIR"; }
+trap cleanup EXIT
+
+docker run -d --name $NAME -p $PORT:3306 -e MYSQL_ROOT_PASSWORD=djpw -e MYSQL_DATABASE=domjudge mariadb:10.4 >/dev/null
+MYSQL="docker exec -i $NAME mysql -uroot -pdjpw domjudge"
+until $MYSQL -e "SELECT 1" >/dev/null 2>&1; do sleep 1; done
+
+$MYSQL <<'SQL'
+CREATE TABLE contest (
+  cid int(4) unsigned NOT NULL AUTO_INCREMENT, externalid varchar(255) DEFAULT NULL, name varchar(255) NOT NULL,
+  shortname varchar(255) NOT NULL, activatetime decimal(32,9) unsigned NOT NULL, starttime decimal(32,9) unsigned NOT NULL,
+  freezetime decimal(32,9) unsigned DEFAULT NULL, endtime decimal(32,9) unsigned NOT NULL,
+  unfreezetime decimal(32,9) unsigned DEFAULT NULL, deactivatetime decimal(32,9) unsigned DEFAULT NULL,
+  activatetime_string varchar(64) NOT NULL, starttime_string varchar(64) NOT NULL, freezetime_string varchar(64) DEFAULT NULL,
+  endtime_string varchar(64) NOT NULL, unfreezetime_string varchar(64) DEFAULT NULL, deactivatetime_string varchar(64) DEFAULT NULL,
+  enabled tinyint(1) unsigned NOT NULL DEFAULT 1, public tinyint(1) unsigned NOT NULL DEFAULT 1,
+  PRIMARY KEY (cid), UNIQUE KEY externalid (externalid), UNIQUE KEY shortname (shortname));
+CREATE TABLE contestproblem (cid int(4) unsigned NOT NULL, probid int(4) unsigned NOT NULL, shortname varchar(255) NOT NULL,
+  points int(4) unsigned NOT NULL DEFAULT 1, allow_submit tinyint(1) unsigned NOT NULL DEFAULT 1,
+  allow_judge tinyint(1) unsigned NOT NULL DEFAULT 1, color varchar(32) DEFAULT NULL, PRIMARY KEY (cid, probid));
+CREATE TABLE team (
+  teamid int(4) unsigned NOT NULL AUTO_INCREMENT, externalid varchar(255) DEFAULT NULL, name varchar(255) NOT NULL,
+  categoryid int(4) unsigned NOT NULL DEFAULT 0, affilid int(4) unsigned DEFAULT NULL, enabled tinyint(1) unsigned NOT NULL DEFAULT 1,
+  members longtext, room varchar(255) DEFAULT NULL, comments longtext, judging_last_started decimal(32,9) unsigned DEFAULT NULL,
+  penalty int(4) NOT NULL DEFAULT 0, PRIMARY KEY (teamid), UNIQUE KEY externalid (externalid));
+CREATE TABLE user (
+  userid int(4) unsigned NOT NULL AUTO_INCREMENT, username varchar(255) NOT NULL, name varchar(255) DEFAULT NULL,
+  email varchar(255) DEFAULT NULL, last_login decimal(32,9) unsigned DEFAULT NULL, last_ip_address varchar(255) DEFAULT NULL,
+  password varchar(255) DEFAULT NULL, ip_address varchar(255) DEFAULT NULL, enabled tinyint(1) unsigned NOT NULL DEFAULT 1,
+  teamid int(4) unsigned DEFAULT NULL, PRIMARY KEY (userid), UNIQUE KEY username (username));
+CREATE TABLE userrole (userid int(4) unsigned NOT NULL, roleid int(4) unsigned NOT NULL, PRIMARY KEY (userid, roleid));
+CREATE TABLE contestteam (cid int(4) unsigned NOT NULL, teamid int(4) unsigned NOT NULL, PRIMARY KEY (cid, teamid));
+CREATE TABLE team_category (categoryid int(4) unsigned NOT NULL AUTO_INCREMENT, name varchar(255) NOT NULL,
+  sortorder tinyint(1) unsigned NOT NULL DEFAULT 0, color varchar(32) DEFAULT NULL, visible tinyint(1) unsigned NOT NULL DEFAULT 1,
+  PRIMARY KEY (categoryid));
+INSERT INTO team_category (categoryid, name) VALUES (3, 'Participants');
+SQL
+
+DB_CONN_STR="root:djpw@tcp(127.0.0.1:$PORT)/domjudge?charset=utf8&parseTime=True&loc=Local"
+$BIN --op CREATE_CONTEST --contest-name "Parallel check" --contest-short-name parallel-check --contest-duration-hours 1 --db-conn-str "$DB_CONN_STR" 2>/dev/null
+
+for run in a b; do
+  for i in $(seq 1 $USERS_PER_RUN); do echo "$run$i@example.com"; done > "$WORKDIR/$run.tsv"
+done
+$BIN --op ADD_USERS --contest-short-name parallel-check --users-file "$WORKDIR/a.tsv" --concurrency 8 --db-conn-str "$DB_CONN_STR" 2>"$WORKDIR/a.log" &
+$BIN --op ADD_USERS --contest-short-name parallel-check --users-file "$WORKDIR/b.tsv" --concurrency 8 --db-conn-str "$DB_CONN_STR" 2>"$WORKDIR/b.log" &
+wait
+
+EXPECTED=$((2 * USERS_PER_RUN))
+# userid and teamid are allocated independently, every user must have a team of its own (1:1 user.teamid -> team)
+RESULT=$($MYSQL -N -e "SELECT COUNT(*), COUNT(DISTINCT u.userid), COUNT(DISTINCT u.teamid), COUNT(t.teamid), (SELECT COUNT(*) FROM team), (SELECT COUNT(*) FROM contestteam) FROM user u LEFT JOIN team t ON t.teamid = u.teamid")
+echo "users, distinct userids, distinct teamids, users with a team, teams, contestteams: $RESULT"
+if [ "$RESULT" != "$(printf '%s\t%s\t%s\t%s\t%s\t%s' $EXPECTED $EXPECTED $EXPECTED $EXPECTED $EXPECTED $EXPECTED)" ]; then
+  echo "FAIL: expected $EXPECTED distinct users, each with a team of its own, and $EXPECTED teams and contestteams"
+  exit 1
+fi
+echo "PASS"
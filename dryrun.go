@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// Dry run mode: every op runs against a single mysql connection inside one transaction which is rolled back
+// when the connection is closed. Transactions of the op become savepoints, DDL statements are skipped and every
+// write statement, email and output file line is recorded in a plan which is printed instead of being applied
+type DryRunPlan struct {
+	mutex sync.Mutex
+	Steps []string
+}
+
+// Record a step of the plan
+func (p *DryRunPlan) Add(kind string, desc string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.Steps = append(p.Steps, fmt.Sprintf("%s: %s", kind, desc))
+}
+
+// Print plan with one step per line
+func (p *DryRunPlan) Print(w io.Writer) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	fmt.Fprintf(w, "DRY RUN PLAN (%d steps, nothing was committed, sent or written)\n", len(p.Steps))
+	for i, step := range p.Steps {
+		fmt.Fprintf(w, "%4d. %s\n", i+1, step)
+	}
+}
+
+// Writer which records every line written to filename as a plan step instead of writing the file
+func (p *DryRunPlan) FileWriter(filename string) io.Writer {
+	return &dryRunFileWriter{plan: p, filename: filename}
+}
+
+type dryRunFileWriter struct {
+	plan     *DryRunPlan
+	filename string
+}
+
+func (w *dryRunFileWriter) Write(b []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(b), "\n"), "\n") {
+		w.plan.Add("WRITE_FILE", fmt.Sprintf("%s <- %s", w.filename, line))
+	}
+	return len(b), nil
+}
+
+// Email sender which records emails in the plan instead of sending them
+type DryRunSender struct {
+	Plan    *DryRunPlan
+	Backend string
+}
+
+func (s *DryRunSender) Send(msg *EmailMessage) error {
+	subject := msg.Subject
+	if subject == "" && msg.TemplateData != nil {
+		subject = fmt.Sprintf("(rendered by %s) %s", s.Backend, msg.TemplateData.Title)
+	}
+	s.Plan.Add("SEND_EMAIL", fmt.Sprintf("via %s to %s <%s> (bcc %s): %s", s.Backend, msg.ToName, msg.To, strings.Join(msg.Bcc, ","), subject))
+	return nil
+}
+
+// Open a mysql db for dry run mode limited to a single connection which never commits
+func OpenDryRunDb(dsn string, plan *DryRunPlan) *sql.DB {
+	db := sql.OpenDB(&dryRunConnector{dsn: dsn, plan: plan})
+	db.SetMaxOpenConns(1)
+	db.SetMaxIdleConns(1)
+	return db
+}
+
+type dryRunConnector struct {
+	dsn  string
+	plan *DryRunPlan
+}
+
+func (c *dryRunConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := mysql.MySQLDriver{}.Open(c.dsn)
+	if err != nil {
+		return nil, err
+	}
+	dc := &dryRunConn{conn: conn, plan: c.plan}
+	if err = dc.execRaw(ctx, "START TRANSACTION"); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return dc, nil
+}
+
+func (c *dryRunConnector) Driver() driver.Driver {
+	return mysql.MySQLDriver{}
+}
+
+type dryRunConn struct {
+	conn       driver.Conn
+	plan       *DryRunPlan
+	savepoints int
+}
+
+func (c *dryRunConn) execRaw(ctx context.Context, query string) error {
+	_, err := c.conn.(driver.ExecerContext).ExecContext(ctx, query, nil)
+	return err
+}
+
+func (c *dryRunConn) Prepare(query string) (driver.Stmt, error) {
+	stmt, err := c.conn.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	return &dryRunStmt{stmt: stmt, query: query, plan: c.plan}, nil
+}
+
+// Outer transaction is rolled back when the connection is closed
+func (c *dryRunConn) Close() error {
+	c.execRaw(context.Background(), "ROLLBACK")
+	return c.conn.Close()
+}
+
+func (c *dryRunConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *dryRunConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	c.savepoints++
+	tx := &dryRunTx{conn: c, name: fmt.Sprintf("dryrun_%d", c.savepoints)}
+	if err := c.execRaw(ctx, "SAVEPOINT "+tx.name); err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
+
+func (c *dryRunConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if isDDL(query) {
+		c.plan.Add("SKIP_DDL", query)
+		return driver.RowsAffected(0), nil
+	}
+	res, err := c.conn.(driver.ExecerContext).ExecContext(ctx, query, args)
+	if err == nil {
+		recordExec(c.plan, query, args, res)
+	}
+	return res, err
+}
+
+func (c *dryRunConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	return c.conn.(driver.QueryerContext).QueryContext(ctx, query, args)
+}
+
+func (c *dryRunConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if checker, ok := c.conn.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+type dryRunTx struct {
+	conn *dryRunConn
+	name string
+}
+
+func (tx *dryRunTx) Commit() error {
+	return tx.conn.execRaw(context.Background(), "RELEASE SAVEPOINT "+tx.name)
+}
+
+func (tx *dryRunTx) Rollback() error {
+	tx.conn.plan.Add("ROLLBACK", "changes of the failed transaction above are discarded")
+	return tx.conn.execRaw(context.Background(), "ROLLBACK TO SAVEPOINT "+tx.name)
+}
+
+type dryRunStmt struct {
+	stmt  driver.Stmt
+	query string
+	plan  *DryRunPlan
+}
+
+func (s *dryRunStmt) Close() error  { return s.stmt.Close() }
+func (s *dryRunStmt) NumInput() int { return s.stmt.NumInput() }
+
+func (s *dryRunStmt) Exec(args []driver.Value) (driver.Result, error) {
+	named := make([]driver.NamedValue, len(args))
+	for i, arg := range args {
+		named[i] = driver.NamedValue{Ordinal: i + 1, Value: arg}
+	}
+	if isDDL(s.query) {
+		s.plan.Add("SKIP_DDL", s.query)
+		return driver.RowsAffected(0), nil
+	}
+	res, err := s.stmt.Exec(args)
+	if err == nil {
+		recordExec(s.plan, s.query, named, res)
+	}
+	return res, err
+}
+
+func (s *dryRunStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.stmt.Query(args)
+}
+
+// DDL statements implicitly commit in mysql, so they can never run in dry run mode
+func isDDL(query string) bool {
+	fields := strings.Fields(strings.ToUpper(query))
+	if len(fields) == 0 {
+		return false
+	}
+	switch fields[0] {
+	case "CREATE", "ALTER", "DROP", "RENAME", "TRUNCATE":
+		return true
+	}
+	return false
+}
+
+// Record write statement with its args inlined and number of affected rows
+func recordExec(plan *DryRunPlan, query string, args []driver.NamedValue, res driver.Result) {
+	var sb strings.Builder
+	argIdx := 0
+	for _, r := range query {
+		if r == '?' && argIdx < len(args) {
+			sb.WriteString(formatSqlValue(args[argIdx].Value))
+			argIdx++
+			continue
+		}
+		sb.WriteRune(r)
+	}
+	rowsAffected, _ := res.RowsAffected()
+	lastInsertId, _ := res.LastInsertId()
+	desc := fmt.Sprintf("%s (%d rows", strings.Join(strings.Fields(sb.String()), " "), rowsAffected)
+	if lastInsertId > 0 {
+		desc += fmt.Sprintf(", id %d", lastInsertId)
+	}
+	plan.Add("SQL", desc+")")
+}
+
+func formatSqlValue(v driver.Value) string {
+	switch val := v.(type) {
+	case nil:
+		return "NULL"
+	case string:
+		return fmt.Sprintf("'%s'", strings.Replace(val, "'", "''", -1))
+	case []byte:
+		return fmt.Sprintf("'%s'", strings.Replace(string(val), "'", "''", -1))
+	case time.Time:
+		return fmt.Sprintf("'%s'", val.Format("2006-01-02 15:04:05"))
+	}
+	return fmt.Sprintf("%v", v)
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Email to be sent to a single candidate
+// Sendwithus renders its own template from TemplateData, other senders send Subject/TextBody/HtmlBody as is
+type EmailMessage struct {
+	To           string               `json:"to"`
+	ToName       string               `json:"to_name"`
+	From         string               `json:"from"`
+	FromName     string               `json:"from_name"`
+	ReplyTo      string               `json:"reply_to"`
+	Cc           []string             `json:"cc"`
+	Bcc          []string             `json:"bcc"`
+	Subject      string               `json:"subject"`
+	TextBody     string               `json:"text_body"`
+	HtmlBody     string               `json:"html_body"`
+	TemplateData *ContestWelcomeEmail `json:"template_data"`
+}
+
+// Email delivery backend
+type EmailSender interface {
+	Send(msg *EmailMessage) error
+}
+
+// Build email sender for email-backend arg: sendwithus, smtp or file
+// Returns nil sender (emails disabled) if no backend is configured
+func NewEmailSender(cliArgs *CliArgs) (sender EmailSender, err error) {
+	switch cliArgs.EmailBackend {
+	case "":
+		return nil, nil
+	case "sendwithus":
+		return &SendwithusSender{ApiKey: cliArgs.SendwithusApiKey, TemplateId: cliArgs.SendwithusTemplateId}, nil
+	case "smtp":
+		return &SmtpSender{
+			Host:         cliArgs.SmtpHost,
+			Port:         cliArgs.SmtpPort,
+			Username:     cliArgs.SmtpUsername,
+			Password:     cliArgs.SmtpPassword,
+			SkipStartTls: cliArgs.SmtpSkipStartTls,
+		}, nil
+	case "file":
+		if err = os.MkdirAll(cliArgs.EmailDir, 0755); err != nil {
+			return nil, PrintErr("EMAIL_DIR_ERR", fmt.Sprintf("failed to create %s: %v", cliArgs.EmailDir, err))
+		}
+		return &FileSender{Dir: cliArgs.EmailDir}, nil
+	}
+	return nil, PrintErr("EMAIL_BACKEND_ERR", fmt.Sprintf("unknown email-backend %s", cliArgs.EmailBackend))
+}
+
+// Sends emails using sendwithus service and a template created in its dashboard
+type SendwithusSender struct {
+	ApiKey     string
+	TemplateId string
+}
+
+func (s *SendwithusSender) Send(msg *EmailMessage) (err error) {
+	_, err = SendEmailUsingSendwithus(msg.To, msg.ToName, msg.From, msg.FromName, msg.ReplyTo,
+		strings.Join(msg.Cc, ","), strings.Join(msg.Bcc, ","), s.ApiKey, s.TemplateId, msg.TemplateData)
+	return err
+}
+
+// Sends emails to an SMTP server, upgrading the connection with STARTTLS
+// (SkipStartTls is only meant for local SMTP stand-ins like MailHog)
+type SmtpSender struct {
+	Host         string
+	Port         int
+	Username     string
+	Password     string
+	SkipStartTls bool
+}
+
+// Time allowed for connecting to the SMTP server and sending one email
+const smtpTimeout = 30 * time.Second
+
+func (s *SmtpSender) Send(msg *EmailMessage) (err error) {
+	data, err := BuildRFC5322Message(msg)
+	if err != nil {
+		return err
+	}
+	addr := net.JoinHostPort(s.Host, fmt.Sprintf("%d", s.Port))
+	conn, err := net.DialTimeout("tcp", addr, smtpTimeout)
+	if err != nil {
+		return PrintErr("SMTP_DIAL_ERR", fmt.Sprintf("%s: %v", addr, err))
+	}
+	// Bounds the whole exchange, a stalled server must not hang the users file worker sending this email
+	if err = conn.SetDeadline(time.Now().Add(smtpTimeout)); err != nil {
+		conn.Close()
+		return PrintErr("SMTP_DIAL_ERR", fmt.Sprintf("%s: %v", addr, err))
+	}
+	client, err := smtp.NewClient(conn, s.Host)
+	if err != nil {
+		conn.Close()
+		return PrintErr("SMTP_DIAL_ERR", fmt.Sprintf("%s: %v", addr, err))
+	}
+	defer client.Close()
+
+	if !s.SkipStartTls {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			return PrintErr("SMTP_STARTTLS_ERR", fmt.Sprintf("%s does not support STARTTLS", addr))
+		}
+		if err = client.StartTLS(&tls.Config{ServerName: s.Host}); err != nil {
+			return PrintErr("SMTP_STARTTLS_ERR", fmt.Sprintf("%s: %v", addr, err))
+		}
+	}
+	if s.Username != "" {
+		if err = client.Auth(smtp.PlainAuth("", s.Username, s.Password, s.Host)); err != nil {
+			return PrintErr("SMTP_AUTH_ERR", fmt.Sprintf("%s (username %s): %v", addr, s.Username, err))
+		}
+	}
+
+	if err = client.Mail(msg.From); err != nil {
+		return PrintErr("SMTP_MAIL_ERR", fmt.Sprintf("(from %s): %v", msg.From, err))
+	}
+	for _, rcpt := range append(append([]string{msg.To}, msg.Cc...), msg.Bcc...) {
+		if err = client.Rcpt(rcpt); err != nil {
+			return PrintErr("SMTP_RCPT_ERR", fmt.Sprintf("(rcpt %s): %v", rcpt, err))
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return PrintErr("SMTP_DATA_ERR", fmt.Sprintf("(to %s): %v", msg.To, err))
+	}
+	if _, err = w.Write(data); err != nil {
+		return PrintErr("SMTP_DATA_ERR", fmt.Sprintf("(to %s): %v", msg.To, err))
+	}
+	if err = w.Close(); err != nil {
+		return PrintErr("SMTP_DATA_ERR", fmt.Sprintf("(to %s): %v", msg.To, err))
+	}
+	log.Printf("SMTP_EMAIL_SENT: (%s) to %s\n", addr, msg.To)
+	return client.Quit()
+}
+
+// Writes emails as RFC 5322 .eml files to a directory instead of sending them
+// Files are written to a temporary name first and renamed, so readers never see partial files
+type FileSender struct {
+	Dir string
+}
+
+var unsafeFileCharsRe = regexp.MustCompile(`[^A-Za-z0-9._@+-]`)
+
+func (s *FileSender) Send(msg *EmailMessage) (err error) {
+	data, err := BuildRFC5322Message(msg)
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%d.%d.%s.eml", time.Now().UnixNano(), os.Getpid(), unsafeFileCharsRe.ReplaceAllString(msg.To, "_"))
+	tmpFilename := filepath.Join(s.Dir, "."+name+".tmp")
+	if err = ioutil.WriteFile(tmpFilename, data, 0600); err != nil {
+		return PrintErr("EMAIL_FILE_WRITE_ERR", fmt.Sprintf("%s: %v", tmpFilename, err))
+	}
+	filename := filepath.Join(s.Dir, name)
+	if err = os.Rename(tmpFilename, filename); err != nil {
+		return PrintErr("EMAIL_FILE_WRITE_ERR", fmt.Sprintf("%s: %v", filename, err))
+	}
+	log.Printf("FILE_EMAIL_WRITTEN: (%s) to %s\n", filename, msg.To)
+	return nil
+}
+
+// Build RFC 5322 message with a text/plain part and (if HtmlBody is set) a text/html alternative
+func BuildRFC5322Message(msg *EmailMessage) (data []byte, err error) {
+	var buf bytes.Buffer
+	header := func(k, v string) {
+		if v != "" {
+			fmt.Fprintf(&buf, "%s: %s\r\n", k, v)
+		}
+	}
+	header("From", formatAddress(msg.FromName, msg.From))
+	header("To", formatAddress(msg.ToName, msg.To))
+	header("Cc", strings.Join(msg.Cc, ", "))
+	header("Reply-To", msg.ReplyTo)
+	header("Subject", mime.QEncoding.Encode("utf-8", msg.Subject))
+	header("Date", time.Now().Format(time.RFC1123Z))
+	header("Message-ID", newMessageId(msg.From))
+	header("MIME-Version", "1.0")
+
+	if msg.HtmlBody == "" {
+		header("Content-Type", "text/plain; charset=utf-8")
+		header("Content-Transfer-Encoding", "quoted-printable")
+		buf.WriteString("\r\n")
+		if err = writeQuotedPrintable(&buf, msg.TextBody); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+
+	mw := multipart.NewWriter(&buf)
+	header("Content-Type", fmt.Sprintf("multipart/alternative; boundary=%s", mw.Boundary()))
+	buf.WriteString("\r\n")
+	for _, part := range []struct{ contentType, body string }{
+		{"text/plain; charset=utf-8", msg.TextBody},
+		{"text/html; charset=utf-8", msg.HtmlBody},
+	} {
+		pw, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, PrintErr("EMAIL_BUILD_ERR", fmt.Sprintf("%v", err))
+		}
+		if err = writeQuotedPrintable(pw, part.body); err != nil {
+			return nil, err
+		}
+	}
+	if err = mw.Close(); err != nil {
+		return nil, PrintErr("EMAIL_BUILD_ERR", fmt.Sprintf("%v", err))
+	}
+	return buf.Bytes(), nil
+}
+
+func formatAddress(name, address string) string {
+	if address == "" || name == "" {
+		return address
+	}
+	return fmt.Sprintf("%s <%s>", mime.QEncoding.Encode("utf-8", name), address)
+}
+
+func newMessageId(from string) string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	domain := "localhost"
+	if idx := strings.LastIndex(from, "@"); idx >= 0 {
+		domain = from[idx+1:]
+	}
+	return fmt.Sprintf("<%s@%s>", hex.EncodeToString(b), domain)
+}
+
+func writeQuotedPrintable(w io.Writer, body string) (err error) {
+	qw := quotedprintable.NewWriter(w)
+	if _, err = qw.Write([]byte(strings.Replace(body, "\n", "\r\n", -1))); err != nil {
+		return PrintErr("EMAIL_BUILD_ERR", fmt.Sprintf("%v", err))
+	}
+	if err = qw.Close(); err != nil {
+		return PrintErr("EMAIL_BUILD_ERR", fmt.Sprintf("%v", err))
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	htmltemplate "html/template"
+	"io/fs"
+	"os"
+	"strings"
+	texttemplate "text/template"
+)
+
+// Default welcome email templates, built into the binary so that it runs from any directory
+//
+//go:embed templates/*.tmpl
+var defaultEmailTemplates embed.FS
+
+// Welcome email templates loaded from a directory with 3 files:
+// welcome.subject.tmpl and welcome.txt.tmpl (text/template), welcome.html.tmpl (html/template)
+// Templates are executed with a ContestWelcomeEmail
+type WelcomeEmailTemplates struct {
+	Subject *texttemplate.Template
+	Text    *texttemplate.Template
+	Html    *htmltemplate.Template
+}
+
+// Load welcome email templates from dir, or the default templates built into the binary if dir is empty
+func LoadWelcomeEmailTemplates(dir string) (templates *WelcomeEmailTemplates, err error) {
+	fsys, _ := fs.Sub(defaultEmailTemplates, "templates")
+	if dir != "" {
+		fsys = os.DirFS(dir)
+	}
+	templates = new(WelcomeEmailTemplates)
+	if templates.Subject, err = texttemplate.ParseFS(fsys, "welcome.subject.tmpl"); err != nil {
+		return nil, PrintErr("EMAIL_TEMPLATE_PARSE_ERR", fmt.Sprintf("%s: %v", getLastStr("default templates", dir), err))
+	}
+	if templates.Text, err = texttemplate.ParseFS(fsys, "welcome.txt.tmpl"); err != nil {
+		return nil, PrintErr("EMAIL_TEMPLATE_PARSE_ERR", fmt.Sprintf("%s: %v", getLastStr("default templates", dir), err))
+	}
+	if templates.Html, err = htmltemplate.ParseFS(fsys, "welcome.html.tmpl"); err != nil {
+		return nil, PrintErr("EMAIL_TEMPLATE_PARSE_ERR", fmt.Sprintf("%s: %v", getLastStr("default templates", dir), err))
+	}
+	return templates, nil
+}
+
+// Render subject, plain text and html body of welcome email
+func (t *WelcomeEmailTemplates) Render(data *ContestWelcomeEmail) (subject string, text string, html string, err error) {
+	var buf bytes.Buffer
+	if err = t.Subject.Execute(&buf, data); err != nil {
+		return "", "", "", PrintErr("EMAIL_TEMPLATE_EXEC_ERR", fmt.Sprintf("subject (to %s): %v", data.Username, err))
+	}
+	subject = strings.TrimSpace(buf.String())
+	buf.Reset()
+	if err = t.Text.Execute(&buf, data); err != nil {
+		return "", "", "", PrintErr("EMAIL_TEMPLATE_EXEC_ERR", fmt.Sprintf("text (to %s): %v", data.Username, err))
+	}
+	text = buf.String()
+	buf.Reset()
+	if err = t.Html.Execute(&buf, data); err != nil {
+		return "", "", "", PrintErr("EMAIL_TEMPLATE_EXEC_ERR", fmt.Sprintf("html (to %s): %v", data.Username, err))
+	}
+	html = buf.String()
+	return subject, text, html, nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Connection string of a throwaway DOMJudge database (e.g. a MariaDB container loaded with DOMJudge's schema),
+// tests which need a database are skipped without it
+const testDbConnStrEnv = "DOMJUDGE_TEST_DB_CONN_STR"
+
+func openTestDb(t *testing.T) *gorm.DB {
+	dbConnStr := os.Getenv(testDbConnStrEnv)
+	if dbConnStr == "" {
+		t.Skipf("%s not set", testDbConnStrEnv)
+	}
+	db, err := gorm.Open("mysql", dbConnStr)
+	if err != nil {
+		t.Fatalf("failed to connect to %s: %v", testDbConnStrEnv, err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// Two loops creating contests and users at the same time must never get the same cid, teamid or userid,
+// and every user must have a team of its own
+func TestConcurrentCreatesGetDistinctIds(t *testing.T) {
+	db := openTestDb(t)
+	config := &Config{CliArgs: &CliArgs{UsernameScheme: "email"}, Db: db, Location: time.UTC}
+	run := time.Now().Unix()
+	const perLoop = 25
+
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	var shortNames []string
+	var users []User
+	errs := make(chan error, 2*perLoop*3)
+	for _, loop := range []string{"a", "b"} {
+		wg.Add(1)
+		go func(loop string) {
+			defer wg.Done()
+			for i := 0; i < perLoop; i++ {
+				shortName := fmt.Sprintf("idcheck-%d-%s-%d", run, loop, i)
+				contest := BuildNewContest("Id check", shortName, 1, time.Time{}, 0, time.UTC)
+				if err := CreateContest(contest, config); err != nil {
+					errs <- err
+					continue
+				}
+				mutex.Lock()
+				shortNames = append(shortNames, shortName)
+				mutex.Unlock()
+				created, err := GetContestByShortName(shortName, config)
+				if err != nil {
+					errs <- err
+					continue
+				}
+
+				entry := UserEntry{Email: fmt.Sprintf("idcheck-%d-%s-%d@example.com", run, loop, i), CategoryId: 3}
+				user, err := CreateUser(entry, created.Cid, config)
+				if err != nil {
+					errs <- err
+					continue
+				}
+				mutex.Lock()
+				users = append(users, user)
+				mutex.Unlock()
+			}
+		}(loop)
+	}
+	wg.Wait()
+	close(errs)
+
+	t.Cleanup(func() { deleteTestRows(db, shortNames, users) })
+	for err := range errs {
+		t.Errorf("create failed: %v", err)
+	}
+
+	cids := make(map[int]string)
+	for _, shortName := range shortNames {
+		contest, err := GetContestByShortName(shortName, config)
+		if err != nil || contest.Cid == 0 {
+			t.Fatalf("contest %s not found: %v", shortName, err)
+		}
+		if other, ok := cids[contest.Cid]; ok {
+			t.Errorf("contests %s and %s share cid %d", other, shortName, contest.Cid)
+		}
+		cids[contest.Cid] = shortName
+	}
+
+	teamIds := make(map[int]string)
+	userIds := make(map[int]string)
+	for _, user := range users {
+		if other, ok := teamIds[user.TeamId]; ok {
+			t.Errorf("users %s and %s share teamid %d", other, user.Email, user.TeamId)
+		}
+		teamIds[user.TeamId] = user.Email
+		if other, ok := userIds[user.UserId]; ok {
+			t.Errorf("users %s and %s share userid %d", other, user.Email, user.UserId)
+		}
+		userIds[user.UserId] = user.Email
+
+		var count int
+		if err := db.Table("user").Joins("JOIN team ON team.teamid = user.teamid").
+			Where("user.userid = ? AND team.teamid = ?", user.UserId, user.TeamId).Count(&count).Error; err != nil {
+			t.Fatalf("failed to read team of %s: %v", user.Email, err)
+		}
+		if count != 1 {
+			t.Errorf("user %s (userid %d) has %d teams with teamid %d, want 1", user.Email, user.UserId, count, user.TeamId)
+		}
+	}
+	if len(cids) != 2*perLoop || len(teamIds) != 2*perLoop || len(userIds) != 2*perLoop {
+		t.Errorf("got %d cids, %d teamids and %d userids, want %d of each", len(cids), len(teamIds), len(userIds), 2*perLoop)
+	}
+}
+
+// Users created at the same time whose emails have the same local part must get distinct usernames with the email
+// scheme, a create which loses the race for a username retries with the next candidate
+func TestConcurrentCreatesGetDistinctUsernames(t *testing.T) {
+	db := openTestDb(t)
+	config := &Config{CliArgs: &CliArgs{UsernameScheme: "email"}, Db: db, Location: time.UTC}
+	run := time.Now().Unix()
+	shortName := fmt.Sprintf("namecheck-%d", run)
+	if err := CreateContest(BuildNewContest("Username check", shortName, 1, time.Time{}, 0, time.UTC), config); err != nil {
+		t.Fatal(err)
+	}
+	contest, err := GetContestByShortName(shortName, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	var users []User
+	for _, domain := range []string{"x", "y", "z"} {
+		wg.Add(1)
+		go func(domain string) {
+			defer wg.Done()
+			entry := UserEntry{Email: fmt.Sprintf("namecheck-%d@%s.example.com", run, domain), CategoryId: 3}
+			user, err := CreateUser(entry, contest.Cid, config)
+			if err != nil {
+				t.Errorf("create %s failed: %v", entry.Email, err)
+				return
+			}
+			mutex.Lock()
+			users = append(users, user)
+			mutex.Unlock()
+		}(domain)
+	}
+	wg.Wait()
+	t.Cleanup(func() { deleteTestRows(db, []string{shortName}, users) })
+
+	usernames := make(map[string]string)
+	for _, user := range users {
+		if other, ok := usernames[user.Username]; ok {
+			t.Errorf("users %s and %s share username %s", other, user.Email, user.Username)
+		}
+		usernames[user.Username] = user.Email
+	}
+}
+
+// Remove contests and users created by a test
+func deleteTestRows(db *gorm.DB, shortNames []string, users []User) {
+	for _, user := range users {
+		db.Exec("DELETE FROM contestteam WHERE teamid = ?", user.TeamId)
+		db.Exec("DELETE FROM userrole WHERE userid = ?", user.UserId)
+		db.Exec("DELETE FROM user WHERE userid = ?", user.UserId)
+		db.Exec("DELETE FROM team WHERE teamid = ?", user.TeamId)
+	}
+	for _, shortName := range shortNames {
+		db.Exec("DELETE FROM contest WHERE shortname = ?", shortName)
+	}
+}
@@ -0,0 +1,464 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jinzhu/gorm"
+)
+
+// Row removed by a destructive op, written as a JSON line to the undo journal before it is deleted
+// All columns are kept (also those not modelled by this service), binary columns are base64 encoded
+type JournalEntry struct {
+	Table  string                 `json:"table"`
+	Row    map[string]interface{} `json:"row"`
+	Base64 []string               `json:"base64,omitempty"`
+}
+
+// Tables which can be journaled in the order their rows are restored (parents before children)
+// IdColumn is set for tables whose id is allocated by AUTO_INCREMENT and may be reallocated on restore,
+// Refs maps columns referring to such ids to the referenced table
+var journalTables = []struct {
+	Name     string
+	IdColumn string
+	Refs     map[string]string
+}{
+	{"contest", "cid", nil},
+	{"contestproblem", "", map[string]string{"cid": "contest"}},
+	{"team", "teamid", nil},
+	{"user", "userid", map[string]string{"teamid": "team"}},
+	{"userrole", "", map[string]string{"userid": "user"}},
+	{"contestteam", "", map[string]string{"cid": "contest", "teamid": "team"}},
+	{"submission", "submitid", map[string]string{"cid": "contest", "teamid": "team"}},
+	{"submission_file", "submitfileid", map[string]string{"submitid": "submission"}},
+	{"judging", "judgingid", map[string]string{"cid": "contest", "submitid": "submission"}},
+	{"judging_run", "runid", map[string]string{"judgingid": "judging"}},
+	{"judging_run_output", "", map[string]string{"runid": "judging_run"}},
+	{"balloon", "balloonid", map[string]string{"submitid": "submission"}},
+	{"scorecache", "", map[string]string{"cid": "contest", "teamid": "team"}},
+	{"rankcache", "", map[string]string{"cid": "contest", "teamid": "team"}},
+	{"clarification", "clarid", map[string]string{"cid": "contest", "sender": "team", "recipient": "team"}},
+	{"team_unread", "", map[string]string{"teamid": "team", "mesgid": "clarification"}},
+	{"event", "eventid", map[string]string{"cid": "contest"}},
+}
+
+// Undo journal of a DELETE_USERS or DELETE_CONTEST run
+// Rows snapshotted in a txn are kept in memory until CommitTx writes them just before the txn commits, rows of a txn
+// which is rolled back were never deleted and must not be restored
+type Journal struct {
+	mutex    sync.Mutex
+	Filename string
+	w        io.Writer
+	file     *os.File
+	rows     int
+	pending  map[*gorm.DB]*journalLines
+}
+
+// Journal lines of a txn which has not committed yet
+type journalLines struct {
+	lines []byte
+	rows  int
+}
+
+// Default journal filename of a destructive op on a contest
+func DefaultJournalFilename(contestShortName string) string {
+	return fmt.Sprintf("%s.%s.journal.jsonl", contestShortName, time.Now().Format("20060102-150405"))
+}
+
+// Open journal for appending, in dry run mode the journal lines go to the plan
+func NewJournal(filename string, plan *DryRunPlan) (journal *Journal, err error) {
+	journal = &Journal{Filename: filename, pending: make(map[*gorm.DB]*journalLines)}
+	if plan != nil {
+		journal.w = plan.FileWriter(filename)
+		return journal, nil
+	}
+	// Only the operator may read the journal, it holds the password hashes of deleted users
+	journal.file, err = os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, PrintErr("JOURNAL_OPEN_ERR", fmt.Sprintf("%s: %v", filename, err))
+	}
+	journal.w = journal.file
+	return journal, nil
+}
+
+// Save all rows of table matching where for the journal of txn tx
+// Must be called (with the txn doing the delete) before the rows are deleted, the rows are written to the journal
+// by CommitTx
+func (j *Journal) Snapshot(tx *gorm.DB, table string, where string, args ...interface{}) (err error) {
+	if j == nil {
+		return nil
+	}
+	rows, err := tx.Raw(fmt.Sprintf("SELECT * FROM `%s` WHERE %s", table, where), args...).Rows()
+	if err != nil {
+		return PrintErr("JOURNAL_READ_ERR", fmt.Sprintf("table %s (%s %v): %v", table, where, args, err))
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return PrintErr("JOURNAL_READ_ERR", fmt.Sprintf("table %s: %v", table, err))
+	}
+
+	var lines []byte
+	count := 0
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		ptrs := make([]interface{}, len(columns))
+		for i := range values {
+			ptrs[i] = &values[i]
+		}
+		if err = rows.Scan(ptrs...); err != nil {
+			return PrintErr("JOURNAL_READ_ERR", fmt.Sprintf("table %s: %v", table, err))
+		}
+		entry := JournalEntry{Table: table, Row: make(map[string]interface{})}
+		for i, column := range columns {
+			switch val := values[i].(type) {
+			case []byte:
+				if utf8.Valid(val) {
+					entry.Row[column] = string(val)
+				} else {
+					entry.Row[column] = base64.StdEncoding.EncodeToString(val)
+					entry.Base64 = append(entry.Base64, column)
+				}
+			case time.Time:
+				entry.Row[column] = val.Format("2006-01-02 15:04:05.999999")
+			default:
+				entry.Row[column] = val
+			}
+		}
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return PrintErr("JOURNAL_ENCODE_ERR", fmt.Sprintf("table %s: %v", table, err))
+		}
+		lines = append(append(lines, line...), '\n')
+		count++
+	}
+	if err = rows.Err(); err != nil {
+		return PrintErr("JOURNAL_READ_ERR", fmt.Sprintf("table %s: %v", table, err))
+	}
+	if count == 0 {
+		return nil
+	}
+
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	if j.pending[tx] == nil {
+		j.pending[tx] = new(journalLines)
+	}
+	j.pending[tx].lines = append(j.pending[tx].lines, lines...)
+	j.pending[tx].rows += count
+	return nil
+}
+
+// Commit txn tx, first writing the rows snapshotted in it to the journal and flushing them to disk so that no row is
+// deleted before it is journaled
+// If the rows cannot be written, tx is rolled back and nothing is deleted. If tx fails to commit, its rows are cut from
+// the journal again (the mutex is held until then, so no rows of other txns were written after them)
+func (j *Journal) CommitTx(tx *gorm.DB) (err error) {
+	if j == nil {
+		return tx.Commit().Error
+	}
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	pending := j.pending[tx]
+	delete(j.pending, tx)
+	if pending == nil {
+		return tx.Commit().Error
+	}
+	var offset int64
+	if j.file != nil {
+		offset, err = j.file.Seek(0, io.SeekEnd)
+	}
+	if err == nil {
+		if _, err = j.w.Write(pending.lines); err == nil && j.file != nil {
+			err = j.file.Sync()
+		}
+	}
+	if err != nil {
+		tx.Rollback()
+		j.truncate(offset)
+		return PrintErr("JOURNAL_WRITE_ERR", fmt.Sprintf("%s: %v, txn rolled back", j.Filename, err))
+	}
+	if err = tx.Commit().Error; err != nil {
+		j.truncate(offset)
+		return err
+	}
+	j.rows += pending.rows
+	return nil
+}
+
+// Cut the rows of a txn which did not commit (written from offset on) from the journal file
+// Failing to do so is only a warning, restoring them later reports them as conflicts as they were never deleted
+func (j *Journal) truncate(offset int64) {
+	if j.file == nil {
+		return
+	}
+	if err := j.file.Truncate(offset); err != nil {
+		log.Printf("JOURNAL_STALE_ROWS: rows after byte %d of %s were not deleted (txn did not commit): %v\n", offset, j.Filename, err)
+	}
+}
+
+// Drop the rows snapshotted in txn tx, called when tx is rolled back
+func (j *Journal) Discard(tx *gorm.DB) {
+	if j == nil {
+		return
+	}
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	delete(j.pending, tx)
+}
+
+// Close journal and log how to restore it
+func (j *Journal) Close() {
+	if j == nil || j.file == nil {
+		return
+	}
+	j.file.Close()
+	if j.rows == 0 {
+		os.Remove(j.Filename)
+		return
+	}
+	log.Printf("JOURNAL: %d deleted rows saved to %s, undo with --op RESTORE --journal %s\n", j.rows, j.Filename, j.Filename)
+}
+
+// Read all entries of a journal file
+func ReadJournal(filename string) (entries []JournalEntry, err error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, PrintErr("JOURNAL_OPEN_ERR", fmt.Sprintf("%v", err))
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		var entry JournalEntry
+		decoder := json.NewDecoder(strings.NewReader(line))
+		decoder.UseNumber()
+		if err = decoder.Decode(&entry); err != nil {
+			return nil, PrintErr("JOURNAL_PARSE_ERR", fmt.Sprintf("%s line %d: %v", filename, lineNum, err))
+		}
+		if journalTableRank(entry.Table) < 0 {
+			return nil, PrintErr("JOURNAL_PARSE_ERR", fmt.Sprintf("%s line %d: unknown table %s", filename, lineNum, entry.Table))
+		}
+		entries = append(entries, entry)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, PrintErr("JOURNAL_READ_ERR", fmt.Sprintf("%s: %v", filename, err))
+	}
+	return entries, nil
+}
+
+func journalTableRank(table string) int {
+	for i, t := range journalTables {
+		if t.Name == table {
+			return i
+		}
+	}
+	return -1
+}
+
+// Re-insert all rows of a journal in one txn, parents before children
+// Ids are kept where they are free, otherwise a new id is allocated and rows referring to it are updated
+// Rows which cannot be inserted (duplicate username/shortname, missing parent) are skipped along with rows
+// referring to them. A report line per row (RESTORED, NEW_ID, CONFLICT or SKIPPED) is printed as TSV to stdout
+func RestoreJournal(filename string, config *Config) (err error) {
+	entries, err := ReadJournal(filename)
+	if err != nil {
+		return err
+	}
+	sort.SliceStable(entries, func(i, k int) bool {
+		return journalTableRank(entries[i].Table) < journalTableRank(entries[k].Table)
+	})
+
+	tx := config.Db.Begin()
+	defer func() {
+		if r := recover(); r != nil {
+			tx.Rollback()
+		}
+	}()
+	if err = tx.Error; err != nil {
+		return PrintErr("TXN_OBJ_ERR", fmt.Sprintf("%v", err))
+	}
+
+	// Old id -> restored id of every table with an id column, ids of rows not restored map to 0
+	idMap := make(map[string]map[int64]int64)
+	audit := AuditEntry{Action: "RESTORE"}
+	counts := make(map[string]int)
+	fmt.Printf("table\trow\tstatus\tdetail\n")
+	for _, entry := range entries {
+		table := journalTables[journalTableRank(entry.Table)]
+		row := entry.Row
+		for _, column := range entry.Base64 {
+			if str, ok := row[column].(string); ok {
+				if row[column], err = base64.StdEncoding.DecodeString(str); err != nil {
+					tx.Rollback()
+					return PrintErr("JOURNAL_PARSE_ERR", fmt.Sprintf("table %s column %s: %v", entry.Table, column, err))
+				}
+			}
+		}
+		desc := describeJournalRow(table.Name, table.IdColumn, table.Refs, row)
+
+		// Point references to restored ids, skip rows whose parent was not restored
+		skipped := ""
+		for column, refTable := range table.Refs {
+			oldId, ok := journalInt(row[column])
+			if !ok {
+				continue
+			}
+			if newId, ok := idMap[refTable][oldId]; ok {
+				if newId == 0 {
+					skipped = fmt.Sprintf("%s %d was not restored", refTable, oldId)
+					break
+				}
+				row[column] = newId
+			}
+		}
+		if skipped != "" {
+			fmt.Printf("%s\t%s\tSKIPPED\t%s\n", table.Name, desc, skipped)
+			if table.IdColumn != "" {
+				oldId, _ := journalInt(row[table.IdColumn])
+				setJournalId(idMap, table.Name, oldId, 0)
+			}
+			continue
+		}
+
+		// Keep id if it is free, let AUTO_INCREMENT allocate a new one otherwise
+		status, detail := "RESTORED", ""
+		var oldId int64
+		if table.IdColumn != "" {
+			oldId, _ = journalInt(row[table.IdColumn])
+			var count int
+			if err = tx.Table(table.Name).Where(fmt.Sprintf("`%s` = ?", table.IdColumn), oldId).Count(&count).Error; err != nil {
+				tx.Rollback()
+				return PrintErr("READ_ID_ERR", fmt.Sprintf("%s %s: %v", table.Name, desc, err))
+			}
+			if count > 0 {
+				delete(row, table.IdColumn)
+				status, detail = "NEW_ID", fmt.Sprintf("%s %d is taken", table.IdColumn, oldId)
+			}
+		}
+
+		if err = insertJournalRow(tx, table.Name, row); err != nil {
+			if mysqlErr, ok := err.(*mysql.MySQLError); ok && (mysqlErr.Number == 1062 || mysqlErr.Number == 1452) {
+				fmt.Printf("%s\t%s\tCONFLICT\t%s\n", table.Name, desc, mysqlErr.Message)
+				if table.IdColumn != "" {
+					setJournalId(idMap, table.Name, oldId, 0)
+				}
+				continue
+			}
+			tx.Rollback()
+			return PrintErr("RESTORE_ROW_ERR", fmt.Sprintf("%s %s: %v", table.Name, desc, err))
+		}
+		if table.IdColumn != "" {
+			newId := oldId
+			if status == "NEW_ID" {
+				if err = tx.Raw("SELECT LAST_INSERT_ID()").Row().Scan(&newId); err != nil {
+					tx.Rollback()
+					return PrintErr("READ_ID_ERR", fmt.Sprintf("%s %s: %v", table.Name, desc, err))
+				}
+				detail = fmt.Sprintf("%s, restored as %d", detail, newId)
+			}
+			setJournalId(idMap, table.Name, oldId, newId)
+			switch table.Name {
+			case "contest":
+				audit.Contest, _ = row["shortname"].(string)
+				audit.Cid = int(newId)
+			case "team":
+				audit.TeamIds = append(audit.TeamIds, int(newId))
+			case "user":
+				audit.UserIds = append(audit.UserIds, int(newId))
+				if email, ok := row["email"].(string); ok {
+					audit.Emails = append(audit.Emails, email)
+				}
+			}
+		}
+		counts[table.Name]++
+		fmt.Printf("%s\t%s\t%s\t%s\n", table.Name, desc, status, detail)
+	}
+
+	if err = tx.Commit().Error; err != nil {
+		return PrintErr("TX_COMMIT_ERR", fmt.Sprintf("Error restoring %s as txn: %v", filename, err))
+	}
+	log.Printf("RESTORE_SUCCESS: (journal: %s, restored rows: %v)\n", filename, counts)
+	config.Audit.Record(audit)
+	return nil
+}
+
+// Insert a journal row with all its columns
+func insertJournalRow(tx *gorm.DB, table string, row map[string]interface{}) (err error) {
+	columns := make([]string, 0, len(row))
+	for column := range row {
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
+	quoted := make([]string, len(columns))
+	values := make([]interface{}, len(columns))
+	for i, column := range columns {
+		quoted[i] = fmt.Sprintf("`%s`", column)
+		values[i] = row[column]
+	}
+	sqlQuery := fmt.Sprintf("INSERT INTO `%s` (%s) VALUES (%s)", table, strings.Join(quoted, ", "),
+		strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", "))
+	return tx.Exec(sqlQuery, values...).Error
+}
+
+// Describe a journal row by its id or by its references, e.g. teamid=14 or cid=2,teamid=14
+func describeJournalRow(table string, idColumn string, refs map[string]string, row map[string]interface{}) string {
+	if idColumn != "" {
+		desc := fmt.Sprintf("%s=%v", idColumn, row[idColumn])
+		for _, column := range []string{"shortname", "username", "name"} {
+			if val, ok := row[column]; ok && val != nil {
+				return fmt.Sprintf("%s (%s %v)", desc, column, val)
+			}
+		}
+		return desc
+	}
+	var parts []string
+	for column := range refs {
+		parts = append(parts, fmt.Sprintf("%s=%v", column, row[column]))
+	}
+	for _, column := range []string{"probid", "roleid"} {
+		if val, ok := row[column]; ok {
+			parts = append(parts, fmt.Sprintf("%s=%v", column, val))
+		}
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
+
+func setJournalId(idMap map[string]map[int64]int64, table string, oldId int64, newId int64) {
+	if idMap[table] == nil {
+		idMap[table] = make(map[int64]int64)
+	}
+	idMap[table][oldId] = newId
+}
+
+// Integer value of a journal column (json.Number after decoding, int64 after remapping)
+func journalInt(v interface{}) (int64, bool) {
+	switch val := v.(type) {
+	case json.Number:
+		i, err := val.Int64()
+		return i, err == nil
+	case int64:
+		return val, true
+	case string:
+		i, err := strconv.ParseInt(val, 10, 64)
+		return i, err == nil
+	}
+	return 0, false
+}
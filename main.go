@@ -3,6 +3,7 @@ package main
 import (
 	"log"
 	"os"
+	"time"
 )
 
 func main() {
@@ -17,22 +18,81 @@ func main() {
 		os.Exit(1)
 	}
 
+	if config.CliArgs.Preview {
+		if err = PreviewContestWelcomeEmail(config.CliArgs.UsersFile, config.CliArgs.ContestShortName, config); err != nil {
+			os.Exit(1)
+		}
+		return
+	}
+
+	err = PerformOp(config)
+	config.Journal.Close()
+	if err != nil {
+		log.Printf("MAIN_ERR: failed to perform (op %s, contest %s): %v", config.CliArgs.Op, config.CliArgs.ContestShortName, err)
+	}
+	if config.Plan != nil {
+		// Closing the only connection rolls back everything the op did
+		config.Db.Close()
+		config.Plan.Print(os.Stdout)
+	}
+	if err != nil {
+		os.Exit(1)
+	}
+}
+
+// Perform the op of config, with a config per job in serve mode
+func PerformOp(config *Config) (err error) {
 	switch config.CliArgs.Op {
 	case "CREATE_CONTEST":
-		newContest := BuildNewContest(config.CliArgs.ContestName, config.CliArgs.ContestShortName, config.CliArgs.ContestDurationHours)
+		var startAt time.Time
+		if config.CliArgs.StartTime != "" {
+			startAt, _ = ParseContestStartTime(config.CliArgs.StartTime, config.Location)
+		}
+		freezeBeforeEnd, _ := time.ParseDuration(config.CliArgs.FreezeBeforeEnd)
+		newContest := BuildNewContest(config.CliArgs.ContestName, config.CliArgs.ContestShortName, config.CliArgs.ContestDurationHours,
+			startAt, freezeBeforeEnd, config.Location)
+		newContest.Problems, _ = ParseContestProblems(config.CliArgs.Problems)
 		err = CreateContest(newContest, config)
+	case "CLONE_CONTEST":
+		var startAt time.Time
+		if config.CliArgs.StartTime != "" {
+			startAt, _ = ParseContestStartTime(config.CliArgs.StartTime, config.Location)
+		}
+		err = CloneContest(config.CliArgs.From, config.CliArgs.ContestName, config.CliArgs.ContestShortName, startAt, config.Location, config)
 	case "ADD_USERS":
 		err = PerformOpOnFile(config.CliArgs.UsersFile, config.CliArgs.ContestShortName, config.CliArgs.Op, config)
 	case "RESEND_EMAIL_USERS":
 		err = PerformOpOnFile(config.CliArgs.UsersFile, config.CliArgs.ContestShortName, config.CliArgs.Op, config)
 	case "DELETE_CONTEST":
-		err = DeleteContestFull(config.CliArgs.ContestShortName, config)
+		err = DeleteContestFull(config.CliArgs.ContestShortName, config.CliArgs.KeepSubmissions, config)
 	case "DELETE_USERS":
 		err = PerformOpOnFile(config.CliArgs.UsersFile, config.CliArgs.ContestShortName, config.CliArgs.Op, config)
 	case "SHOW_RESULTS":
-		err = ExportResultsTSV(config.CliArgs.ContestShortName, config)
-	}
-	if err != nil {
-		log.Printf("MAIN_ERR: failed to perform (op %s, contest %s): %v", config.CliArgs.Op, config.CliArgs.ContestShortName, err)
+		err = ExportResults(config.CliArgs.ContestShortName, config)
+	case "CREATE_CATEGORY":
+		_, err = CreateCategory(config.CliArgs.CategoryName, config.CliArgs.CategorySortOrder, config.CliArgs.CategoryColor, !config.CliArgs.CategoryHidden, config.Db)
+	case "LIST_CATEGORIES":
+		err = ListCategories(config)
+	case "CREATE_AFFILIATION":
+		_, err = CreateAffiliation(config.CliArgs.AffiliationShortName, config.CliArgs.AffiliationName, config.CliArgs.AffiliationCountry, config.Db)
+	case "LIST_AFFILIATIONS":
+		err = ListAffiliations(config)
+	case "DELETE_AFFILIATION":
+		err = DeleteAffiliation(config.CliArgs.AffiliationShortName, config)
+	case "RESTORE":
+		err = RestoreJournal(config.CliArgs.Journal, config)
+	case "EXPORT_SUBMISSIONS":
+		err = ExportSubmissions(config.CliArgs.ContestShortName, config.CliArgs.OutputDir, config)
+	case "SIMILARITY_REPORT":
+		err = SimilarityReport(config.CliArgs.ContestShortName, config.CliArgs.SimilarityThreshold, config.CliArgs.ReportFile, config)
+	case "CANDIDATE_REPORT":
+		err = WriteCandidateReport(config.CliArgs.ContestShortName, config.CliArgs.Email, config.CliArgs.ReportFormat, config.CliArgs.ReportFile, config)
+	case "SERVE":
+		err = Serve(config)
+	case "SHOW_AUDIT":
+		err = ShowAudit(config.CliArgs.ContestShortName, config.CliArgs.Email, config)
+	case "START_CONTEST", "END_CONTEST", "FREEZE_CONTEST", "UNFREEZE_CONTEST":
+		err = ChangeContestState(config.CliArgs.ContestShortName, config.CliArgs.Op, config.CliArgs.ContestDurationHours, config)
 	}
+	return err
 }
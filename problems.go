@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Parse comma separated list of contest problems
+// Each entry is of the form [LETTER=]problem[:points[:color[:allow_submit[:allow_judge]]]] where problem is
+// the problem's externalid or probid, e.g. "A=hello:1:red,B=fizzbuzz:2,42"
+// LETTER defaults to A, B, C... by position (up to Z), points to 1 and allow_submit/allow_judge to 1
+// Shortnames must be unique within the contest, DOMJudge would show two problems under one label otherwise
+func ParseContestProblems(spec string) (problems []ContestProblem, err error) {
+	problems = make([]ContestProblem, 0)
+	if strings.TrimSpace(spec) == "" {
+		return problems, nil
+	}
+	shortNames := make(map[string]int)
+	for i, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		problem := ContestProblem{
+			Points:      1,
+			AllowSubmit: 1,
+			AllowJudge:  1,
+		}
+		if i < 26 {
+			problem.ShortName = string(rune('A' + i))
+		}
+		if idx := strings.Index(entry, "="); idx >= 0 {
+			problem.ShortName = strings.TrimSpace(entry[:idx])
+			entry = entry[idx+1:]
+		}
+		fields := strings.Split(entry, ":")
+		problem.ProblemRef = strings.TrimSpace(fields[0])
+		if problem.ProblemRef == "" {
+			return nil, fmt.Errorf("problem entry %d (%s) has an empty problem", i+1, entry)
+		}
+		if problem.ShortName == "" && i >= 26 {
+			return nil, fmt.Errorf("problem entry %d (%s) needs a LETTER=, default letters end at Z", i+1, entry)
+		}
+		if problem.ShortName == "" {
+			return nil, fmt.Errorf("problem entry %d (%s) has an empty shortname", i+1, entry)
+		}
+		if prev, ok := shortNames[strings.ToUpper(problem.ShortName)]; ok {
+			return nil, fmt.Errorf("problem entries %d and %d have the same shortname %s", prev, i+1, problem.ShortName)
+		}
+		shortNames[strings.ToUpper(problem.ShortName)] = i + 1
+		if len(fields) > 1 && fields[1] != "" {
+			if problem.Points, err = strconv.Atoi(fields[1]); err != nil {
+				return nil, fmt.Errorf("problem %s has invalid points %s", problem.ProblemRef, fields[1])
+			}
+		}
+		if len(fields) > 2 && fields[2] != "" {
+			color := fields[2]
+			problem.Color = &color
+		}
+		if len(fields) > 3 && fields[3] != "" {
+			if problem.AllowSubmit, err = strconv.Atoi(fields[3]); err != nil {
+				return nil, fmt.Errorf("problem %s has invalid allow_submit %s", problem.ProblemRef, fields[3])
+			}
+		}
+		if len(fields) > 4 && fields[4] != "" {
+			if problem.AllowJudge, err = strconv.Atoi(fields[4]); err != nil {
+				return nil, fmt.Errorf("problem %s has invalid allow_judge %s", problem.ProblemRef, fields[4])
+			}
+		}
+		problems = append(problems, problem)
+	}
+	return problems, nil
+}
+
+// Get problem from mysql db by probid (if numeric) or externalid
+func GetProblemByRef(problemRef string, db *gorm.DB) (problem Problem, err error) {
+	var problems []Problem
+	query := db.Table("problem").Limit(1)
+	if probId, convErr := strconv.Atoi(problemRef); convErr == nil {
+		query = query.Where("probid = ?", probId)
+	} else {
+		query = query.Where("externalid = ?", problemRef)
+	}
+	if err = query.Find(&problems).Error; err != nil {
+		return problem, PrintErr("READ_PROBLEM_ERR", fmt.Sprintf("(problem %s): %v", problemRef, err))
+	}
+	if len(problems) == 0 {
+		return problem, PrintErr("PROBLEM_NOT_FOUND", fmt.Sprintf("(problem %s)", problemRef))
+	}
+	return problems[0], nil
+}
+
+// Add problems to a contest in contestproblem table
+func AddContestProblems(contestId int, problems []ContestProblem, db *gorm.DB) (err error) {
+	for _, contestProblem := range problems {
+		if contestProblem.ProbId == 0 {
+			problem, err := GetProblemByRef(contestProblem.ProblemRef, db)
+			if err != nil {
+				return err
+			}
+			contestProblem.ProbId = problem.ProbId
+		}
+		contestProblem.Cid = contestId
+		PrintVal("NEW_CONTESTPROBLEM", contestProblem)
+		if err = db.Table("contestproblem").Create(contestProblem).Error; err != nil {
+			return PrintErr("INSERT_CONTESTPROBLEM_TABLE_ERR", fmt.Sprintf("Error inserting problem %s (%s) into 'contestproblem' table: %v",
+				contestProblem.ProblemRef, contestProblem.ShortName, err))
+		}
+		log.Printf("ADD_CONTESTPROBLEM_SUCCESS: (contestid: %d, probid: %d, shortname: %s)\n", contestId, contestProblem.ProbId, contestProblem.ShortName)
+	}
+	return nil
+}
+
+// Get all problems of a contest from contestproblem table
+func GetContestProblems(contestId int, db *gorm.DB) (problems []ContestProblem, err error) {
+	if err = db.Table("contestproblem").Where("cid = ?", contestId).Order("shortname asc").Find(&problems).Error; err != nil {
+		return nil, PrintErr("READ_CONTESTPROBLEMS_ERR", fmt.Sprintf("(contestid %d): %v", contestId, err))
+	}
+	for i := range problems {
+		problems[i].ProblemRef = strconv.Itoa(problems[i].ProbId)
+	}
+	return problems, nil
+}
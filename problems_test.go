@@ -0,0 +1,92 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseContestProblems(t *testing.T) {
+	red := "red"
+	tests := []struct {
+		name    string
+		spec    string
+		want    []ContestProblem
+		wantErr string
+	}{
+		{name: "empty", spec: "  ", want: []ContestProblem{}},
+		{
+			name: "default letters and values",
+			spec: "hello, fizzbuzz,42",
+			want: []ContestProblem{
+				{ShortName: "A", ProblemRef: "hello", Points: 1, AllowSubmit: 1, AllowJudge: 1},
+				{ShortName: "B", ProblemRef: "fizzbuzz", Points: 1, AllowSubmit: 1, AllowJudge: 1},
+				{ShortName: "C", ProblemRef: "42", Points: 1, AllowSubmit: 1, AllowJudge: 1},
+			},
+		},
+		{
+			name: "explicit letters, points, color and flags",
+			spec: "X=hello:3:red:0:1,Y=fizzbuzz::",
+			want: []ContestProblem{
+				{ShortName: "X", ProblemRef: "hello", Points: 3, Color: &red, AllowSubmit: 0, AllowJudge: 1},
+				{ShortName: "Y", ProblemRef: "fizzbuzz", Points: 1, AllowSubmit: 1, AllowJudge: 1},
+			},
+		},
+		{name: "duplicate explicit letters", spec: "A=hello,B=fizzbuzz,A=42", wantErr: "entries 1 and 3 have the same shortname A"},
+		{name: "duplicate letters ignore case", spec: "a=hello,A=fizzbuzz", wantErr: "same shortname A"},
+		{name: "explicit letter clashes with default", spec: "B=hello,fizzbuzz", wantErr: "entries 1 and 2 have the same shortname B"},
+		{name: "defaults end at Z", spec: strings.Repeat("p,", 26) + "q", wantErr: "problem entry 27 (q) needs a LETTER="},
+		{name: "explicit letter past Z", spec: strings.Repeat("p,", 26) + "AA=q", want: nil},
+		{name: "empty problem", spec: "A=", wantErr: "has an empty problem"},
+		{name: "empty shortname", spec: " =hello", wantErr: "has an empty shortname"},
+		{name: "invalid points", spec: "hello:x", wantErr: "invalid points x"},
+		{name: "invalid allow_submit", spec: "hello:1:red:y", wantErr: "invalid allow_submit y"},
+		{name: "invalid allow_judge", spec: "hello:1:red:1:z", wantErr: "invalid allow_judge z"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseContestProblems(tt.spec)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("ParseContestProblems(%q) error = %v, want %q", tt.spec, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseContestProblems(%q) error = %v", tt.spec, err)
+			}
+			if tt.want == nil {
+				return
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("ParseContestProblems(%q) = %d problems, want %d", tt.spec, len(got), len(tt.want))
+			}
+			for i := range got {
+				if !sameContestProblem(got[i], tt.want[i]) {
+					t.Errorf("problem %d = %+v, want %+v", i+1, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestParseContestProblemsLettersPastZ(t *testing.T) {
+	problems, err := ParseContestProblems(strings.Repeat("p,", 26) + "AA=q")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var letters []string
+	for _, problem := range problems {
+		letters = append(letters, problem.ShortName)
+	}
+	if got, want := strings.Join(letters, ""), "ABCDEFGHIJKLMNOPQRSTUVWXYZAA"; got != want {
+		t.Errorf("letters = %s, want %s", got, want)
+	}
+}
+
+func sameContestProblem(a, b ContestProblem) bool {
+	if (a.Color == nil) != (b.Color == nil) || (a.Color != nil && *a.Color != *b.Color) {
+		return false
+	}
+	return a.ShortName == b.ShortName && a.ProblemRef == b.ProblemRef && a.Points == b.Points &&
+		a.AllowSubmit == b.AllowSubmit && a.AllowJudge == b.AllowJudge
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// Formats supported for results-file
+var resultsFormats = map[string]bool{"tsv": true, "csv": true, "json": true, "ndjson": true, "markdown": true, "html": true}
+
+// Formats which can be appended to an existing results-file (a second JSON array or HTML document would be invalid)
+var appendableResultsFormats = map[string]bool{"tsv": true, "csv": true, "ndjson": true, "markdown": true}
+
+// Result of a user in a contest, as written to results-file
+type ResultRow struct {
+	Rank      int            `json:"rank"`
+	Email     string         `json:"email"`
+	Username  string         `json:"username"`
+	UserId    int            `json:"userid"`
+	ContestId int            `json:"contestid"`
+	Points    int            `json:"points"`
+	TotalTime int64          `json:"totaltime"`
+	Problems  []ProblemScore `json:"problems"`
+}
+
+// Results of a contest in the order of its scoreboard
+type ContestResults struct {
+	Contest     string           `json:"contest"`
+	GeneratedAt time.Time        `json:"generated_at"`
+	Problems    []ContestProblem `json:"-"`
+	Rows        []ResultRow      `json:"results"`
+}
+
+// Fetch contest results and export them to results-file in results-format
+// The file is truncated unless append is set, appended tsv/csv files get no second header
+func ExportResults(contestShortName string, config *Config) (err error) {
+	results, err := FetchContestResults(contestShortName, config)
+	if err != nil {
+		return err
+	}
+
+	outputFilename := config.CliArgs.ResultsFile
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if config.CliArgs.Append {
+		flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	}
+	outputFile, err := os.OpenFile(outputFilename, flags, 0644)
+	if err != nil {
+		return PrintErr("FILE_WOPEN_ERR", fmt.Sprintf("%s: %v", outputFilename, err))
+	}
+	defer outputFile.Close()
+	header := true
+	if config.CliArgs.Append {
+		if info, err := outputFile.Stat(); err == nil && info.Size() > 0 {
+			header = false
+		}
+	}
+
+	if err = WriteResults(outputFile, config.CliArgs.ResultsFormat, header, results); err != nil {
+		return PrintErr("RESULTS_WRITE_ERR", fmt.Sprintf("failed to write %s results to %s: %v", config.CliArgs.ResultsFormat, outputFilename, err))
+	}
+	return nil
+}
+
+// Fetch results of a contest in the order of its scoreboard
+func FetchContestResults(contestShortName string, config *Config) (results *ContestResults, err error) {
+	users, teamScores, problems, err := FetchResults(contestShortName, config)
+	if err != nil {
+		return nil, err
+	}
+	results = &ContestResults{Contest: contestShortName, GeneratedAt: time.Now(), Problems: problems}
+	for i := range users {
+		results.Rows = append(results.Rows, ResultRow{
+			Rank:      i + 1,
+			Email:     users[i].Email,
+			Username:  users[i].Name,
+			UserId:    users[i].UserId,
+			ContestId: teamScores[i].Cid,
+			Points:    teamScores[i].Points,
+			TotalTime: teamScores[i].TimeTaken,
+			Problems:  teamScores[i].Problems,
+		})
+	}
+	return results, nil
+}
+
+// Write results in one of resultsFormats, header is left out of tsv/csv when appending to an existing file
+func WriteResults(w io.Writer, format string, header bool, results *ContestResults) (err error) {
+	switch format {
+	case "tsv":
+		err = writeResultsTable(w, '\t', header, results)
+	case "csv":
+		err = writeResultsTable(w, ',', header, results)
+	case "json":
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(results)
+	case "ndjson":
+		encoder := json.NewEncoder(w)
+		for _, row := range results.Rows {
+			if err = encoder.Encode(row); err != nil {
+				break
+			}
+		}
+	case "markdown":
+		err = writeResultsMarkdown(w, results)
+	case "html":
+		err = resultsHtmlTemplate.Execute(w, results)
+	default:
+		err = fmt.Errorf("unknown results format %s", format)
+	}
+	return err
+}
+
+// Header and rows of results as table cells
+// Every problem adds a group of columns <letter>_solved, <letter>_submissions, <letter>_pending, <letter>_time
+func resultsTable(results *ContestResults) (header []string, rows [][]string) {
+	header = []string{"email", "username", "userid", "contestid", "points", "totaltime"}
+	for _, problem := range results.Problems {
+		header = append(header, problem.ShortName+"_solved", problem.ShortName+"_submissions", problem.ShortName+"_pending", problem.ShortName+"_time")
+	}
+	for _, row := range results.Rows {
+		cells := []string{row.Email, row.Username, fmt.Sprintf("%d", row.UserId), fmt.Sprintf("%d", row.ContestId),
+			fmt.Sprintf("%d", row.Points), fmt.Sprintf("%d", row.TotalTime)}
+		for _, problemScore := range row.Problems {
+			solved := "0"
+			if problemScore.Solved {
+				solved = "1"
+			}
+			cells = append(cells, solved, fmt.Sprintf("%d", problemScore.Submissions), fmt.Sprintf("%d", problemScore.Pending), fmt.Sprintf("%d", problemScore.Time))
+		}
+		rows = append(rows, cells)
+	}
+	return header, rows
+}
+
+// Write results as delimiter separated values (csv quoting rules apply only to comma)
+func writeResultsTable(w io.Writer, delimiter rune, header bool, results *ContestResults) (err error) {
+	headerCells, rows := resultsTable(results)
+	if header {
+		rows = append([][]string{headerCells}, rows...)
+	}
+	if delimiter == ',' {
+		writer := csv.NewWriter(w)
+		writer.WriteAll(rows)
+		return writer.Error()
+	}
+	for _, cells := range rows {
+		if _, err = io.WriteString(w, strings.Join(cells, "\t")+"\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Write results as a markdown table with one column per problem, e.g. "✔ 2 (35')" for solved in 2 tries after 35 minutes
+func writeResultsMarkdown(w io.Writer, results *ContestResults) (err error) {
+	escape := strings.NewReplacer("|", "\\|", "\n", " ")
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "### %s (%s)\n\n", escape.Replace(results.Contest), results.GeneratedAt.Format("2006-01-02 15:04"))
+	sb.WriteString("| rank | email | username | points | totaltime |")
+	for _, problem := range results.Problems {
+		fmt.Fprintf(&sb, " %s |", escape.Replace(problem.ShortName))
+	}
+	sb.WriteString("\n|---:|---|---|---:|---:|")
+	for range results.Problems {
+		sb.WriteString(":---:|")
+	}
+	sb.WriteString("\n")
+	for _, row := range results.Rows {
+		fmt.Fprintf(&sb, "| %d | %s | %s | %d | %d |", row.Rank, escape.Replace(row.Email), escape.Replace(row.Username), row.Points, row.TotalTime)
+		for _, problemScore := range row.Problems {
+			fmt.Fprintf(&sb, " %s |", problemScoreCell(problemScore))
+		}
+		sb.WriteString("\n")
+	}
+	sb.WriteString("\n")
+	_, err = io.WriteString(w, sb.String())
+	return err
+}
+
+// Short text of a scoreboard cell
+func problemScoreCell(problemScore ProblemScore) string {
+	switch {
+	case problemScore.Solved:
+		return fmt.Sprintf("✔ %d (%d')", problemScore.Submissions, problemScore.Time)
+	case problemScore.Pending > 0:
+		return fmt.Sprintf("? %d", problemScore.Submissions)
+	case problemScore.Submissions > 0:
+		return fmt.Sprintf("✘ %d", problemScore.Submissions)
+	}
+	return ""
+}
+
+// Self-contained HTML report (no external CSS or scripts) laid out like DOMJudge scoreboard
+var resultsHtmlTemplate = htmltemplate.Must(htmltemplate.New("results").Funcs(htmltemplate.FuncMap{
+	"cell": problemScoreCell,
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Results: {{.Contest}}</title>
+<style>
+body { font-family: -apple-system, "Segoe UI", Helvetica, Arial, sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: center; }
+td.left, th.left { text-align: left; }
+td.solved { background: #60e760; }
+td.pending { background: #6666ff; color: #fff; }
+td.failed { background: #e87272; }
+caption { text-align: left; color: #666; padding-bottom: 6px; }
+</style>
+</head>
+<body>
+<h1>{{.Contest}}</h1>
+<table>
+<caption>Generated {{.GeneratedAt.Format "2006-01-02 15:04:05 MST"}}, {{len .Rows}} candidates</caption>
+<tr><th>#</th><th class="left">email</th><th class="left">username</th><th>points</th><th>time</th>{{range .Problems}}<th>{{.ShortName}}</th>{{end}}</tr>
+{{range .Rows}}<tr><td>{{.Rank}}</td><td class="left">{{.Email}}</td><td class="left">{{.Username}}</td><td>{{.Points}}</td><td>{{.TotalTime}}</td>{{range .Problems}}<td class="{{if .Solved}}solved{{else if gt .Pending 0}}pending{{else if gt .Submissions 0}}failed{{end}}">{{cell .}}</td>{{end}}</tr>
+{{end}}</table>
+</body>
+</html>
+`))
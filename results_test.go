@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testContestResults() *ContestResults {
+	return &ContestResults{
+		Contest:     "fs-1|may",
+		GeneratedAt: time.Date(2019, 5, 1, 10, 30, 0, 0, time.UTC),
+		Problems:    []ContestProblem{{ShortName: "A"}, {ShortName: "B"}},
+		Rows: []ResultRow{
+			{Rank: 1, Email: "jane@x.com", Username: "Doe, Jane", UserId: 7, ContestId: 3, Points: 1, TotalTime: 35,
+				Problems: []ProblemScore{{ShortName: "A", Solved: true, Submissions: 2, Time: 35}, {ShortName: "B", Submissions: 1}}},
+			{Rank: 2, Email: "joe@x.com", Username: "Joe|Bloggs", UserId: 8, ContestId: 3,
+				Problems: []ProblemScore{{ShortName: "A", Pending: 1, Submissions: 1}, {ShortName: "B"}}},
+		},
+	}
+}
+
+func TestWriteResults(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		header bool
+		want   string
+	}{
+		{
+			name:   "tsv",
+			format: "tsv",
+			header: true,
+			want: "email\tusername\tuserid\tcontestid\tpoints\ttotaltime\tA_solved\tA_submissions\tA_pending\tA_time\tB_solved\tB_submissions\tB_pending\tB_time\n" +
+				"jane@x.com\tDoe, Jane\t7\t3\t1\t35\t1\t2\t0\t35\t0\t1\t0\t0\n" +
+				"joe@x.com\tJoe|Bloggs\t8\t3\t0\t0\t0\t1\t1\t0\t0\t0\t0\t0\n",
+		},
+		{
+			name:   "tsv without header",
+			format: "tsv",
+			want: "jane@x.com\tDoe, Jane\t7\t3\t1\t35\t1\t2\t0\t35\t0\t1\t0\t0\n" +
+				"joe@x.com\tJoe|Bloggs\t8\t3\t0\t0\t0\t1\t1\t0\t0\t0\t0\t0\n",
+		},
+		{
+			name:   "csv quotes commas",
+			format: "csv",
+			header: true,
+			want: "email,username,userid,contestid,points,totaltime,A_solved,A_submissions,A_pending,A_time,B_solved,B_submissions,B_pending,B_time\n" +
+				"jane@x.com,\"Doe, Jane\",7,3,1,35,1,2,0,35,0,1,0,0\n" +
+				"joe@x.com,Joe|Bloggs,8,3,0,0,0,1,1,0,0,0,0,0\n",
+		},
+		{
+			name:   "csv without header",
+			format: "csv",
+			want: "jane@x.com,\"Doe, Jane\",7,3,1,35,1,2,0,35,0,1,0,0\n" +
+				"joe@x.com,Joe|Bloggs,8,3,0,0,0,1,1,0,0,0,0,0\n",
+		},
+		{
+			name:   "ndjson has a line per user",
+			format: "ndjson",
+			want: `{"rank":1,"email":"jane@x.com","username":"Doe, Jane","userid":7,"contestid":3,"points":1,"totaltime":35,"problems":[{"shortname":"A","probid":0,"solved":true,"submissions":2,"pending":0,"time":35},{"shortname":"B","probid":0,"solved":false,"submissions":1,"pending":0,"time":0}]}` + "\n" +
+				`{"rank":2,"email":"joe@x.com","username":"Joe|Bloggs","userid":8,"contestid":3,"points":0,"totaltime":0,"problems":[{"shortname":"A","probid":0,"solved":false,"submissions":1,"pending":1,"time":0},{"shortname":"B","probid":0,"solved":false,"submissions":0,"pending":0,"time":0}]}` + "\n",
+		},
+		{
+			name:   "markdown escapes pipes",
+			format: "markdown",
+			want: "### fs-1\\|may (2019-05-01 10:30)\n\n" +
+				"| rank | email | username | points | totaltime | A | B |\n" +
+				"|---:|---|---|---:|---:|:---:|:---:|\n" +
+				"| 1 | jane@x.com | Doe, Jane | 1 | 35 | ✔ 2 (35') | ✘ 1 |\n" +
+				"| 2 | joe@x.com | Joe\\|Bloggs | 0 | 0 | ? 1 |  |\n\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := WriteResults(&buf, tt.format, tt.header, testContestResults()); err != nil {
+				t.Fatalf("WriteResults error = %v", err)
+			}
+			if got := buf.String(); got != tt.want {
+				t.Errorf("WriteResults =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+// Appending results to a file which already has some (ExportResults with append) must not repeat the header
+func TestWriteResultsAppendWithoutHeader(t *testing.T) {
+	for _, format := range []string{"tsv", "csv"} {
+		t.Run(format, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := WriteResults(&buf, format, true, testContestResults()); err != nil {
+				t.Fatal(err)
+			}
+			if err := WriteResults(&buf, format, false, testContestResults()); err != nil {
+				t.Fatal(err)
+			}
+			lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+			if len(lines) != 5 {
+				t.Fatalf("got %d lines, want a header and 4 rows:\n%s", len(lines), buf.String())
+			}
+			for i, line := range lines[1:] {
+				if strings.HasPrefix(line, "email") {
+					t.Errorf("line %d repeats the header: %s", i+2, line)
+				}
+			}
+		})
+	}
+}
+
+func TestWriteResultsJsonAndHtml(t *testing.T) {
+	tests := []struct {
+		format   string
+		contains []string
+	}{
+		{"json", []string{`"contest": "fs-1|may"`, `"results": [`, `"email": "joe@x.com"`}},
+		{"html", []string{"<html", "jane@x.com", "Joe|Bloggs"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := WriteResults(&buf, tt.format, true, testContestResults()); err != nil {
+				t.Fatalf("WriteResults error = %v", err)
+			}
+			for _, s := range tt.contains {
+				if !strings.Contains(buf.String(), s) {
+					t.Errorf("%s results do not contain %q:\n%s", tt.format, s, buf.String())
+				}
+			}
+		})
+	}
+	if err := WriteResults(&bytes.Buffer{}, "xml", true, testContestResults()); err == nil {
+		t.Errorf("WriteResults with unknown format xml succeeded")
+	}
+}
@@ -0,0 +1,500 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Largest request body accepted by the admin service
+const maxRequestBytes = 10 << 20
+
+// Most jobs waiting to run, more requests are refused until some have run
+const maxQueuedJobs = 1024
+
+// Body of REST API requests, fields are named like in the config file and override the values the service was
+// started with. Only fields an op of the API uses are accepted, connection and email settings stay those of the service
+type ApiRequest struct {
+	ContestName          string      `json:"contest-name"`
+	ContestShortName     string      `json:"contest-short-name"`
+	ContestDurationHours int         `json:"contest-duration-hours"`
+	Problems             string      `json:"problems"`
+	StartTime            string      `json:"start-time"`
+	FreezeBeforeEnd      string      `json:"freeze-before-end"`
+	Timezone             string      `json:"timezone"`
+	Category             string      `json:"category"`
+	AffiliationShortName string      `json:"affiliation-short-name"`
+	KeepSubmissions      bool        `json:"keep-submissions"`
+	Operator             string      `json:"operator"`
+	Users                []UserEntry `json:"users"`
+}
+
+// Line of the user details file of a users job
+// Passwords are never part of a job, they are read from the user details file when it is served
+type UserDetails struct {
+	Email    string `json:"email"`
+	Username string `json:"username"`
+	Password string `json:"-"`
+	TeamId   int    `json:"teamid"`
+}
+
+// Line of the results file of a users job
+type UserResult struct {
+	Email  string `json:"email"`
+	Result string `json:"result"`
+}
+
+// Mutation queued by the REST API, jobs run one at a time in the order they were queued
+// Status is one of queued, running, succeeded, failed
+type Job struct {
+	Id         int           `json:"id"`
+	Op         string        `json:"op"`
+	Contest    string        `json:"contest"`
+	Operator   string        `json:"operator"`
+	Status     string        `json:"status"`
+	Error      string        `json:"error,omitempty"`
+	CreatedAt  time.Time     `json:"created_at"`
+	StartedAt  *time.Time    `json:"started_at,omitempty"`
+	FinishedAt *time.Time    `json:"finished_at,omitempty"`
+	UsersFile  string        `json:"users_file,omitempty"`
+	Journal    string        `json:"journal,omitempty"`
+	Users      []UserDetails `json:"users,omitempty"`
+	Results    []UserResult  `json:"results,omitempty"`
+
+	args *CliArgs
+}
+
+// Admin service performing ops over the database connection of config
+type Server struct {
+	config *Config
+	mutex  sync.Mutex
+	jobs   map[int]*Job
+	nextId int
+	queue  chan *Job
+}
+
+// Run the admin service on listen until it fails
+func Serve(config *Config) (err error) {
+	if err = os.MkdirAll(config.CliArgs.JobsDir, 0755); err != nil {
+		return PrintErr("JOBS_DIR_ERR", fmt.Sprintf("%s: %v", config.CliArgs.JobsDir, err))
+	}
+	server := NewServer(config)
+	go server.runJobs()
+	log.Printf("SERVE: (listen: %s, jobs-dir: %s, api-token: %t)\n", config.CliArgs.Listen, config.CliArgs.JobsDir, config.CliArgs.ApiToken != "")
+	if err = http.ListenAndServe(config.CliArgs.Listen, server.Handler()); err != nil {
+		return PrintErr("SERVE_ERR", fmt.Sprintf("%v", err))
+	}
+	return nil
+}
+
+func NewServer(config *Config) *Server {
+	return &Server{config: config, jobs: make(map[int]*Job), queue: make(chan *Job, maxQueuedJobs)}
+}
+
+// Routes of the REST API:
+//
+//	POST   /api/contests                              CREATE_CONTEST
+//	DELETE /api/contests/<shortname>                  DELETE_CONTEST
+//	POST   /api/contests/<shortname>/users            ADD_USERS
+//	POST   /api/contests/<shortname>/users/resend     RESEND_EMAIL_USERS
+//	POST   /api/contests/<shortname>/users/delete     DELETE_USERS
+//	GET    /api/contests/<shortname>/results?format=  SHOW_RESULTS, written to the response
+//	GET    /api/jobs, /api/jobs/<id>                  Status of jobs
+//	GET    /api/jobs/<id>/details                     User details file of a users job, with the passwords of new users
+//
+// and the pages of the web UI (see registerUi)
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/contests", s.handleContests)
+	mux.HandleFunc("/api/contests/", s.handleContest)
+	mux.HandleFunc("/api/jobs", s.handleJobs)
+	mux.HandleFunc("/api/jobs/", s.handleJob)
+	s.registerUi(mux)
+	return s.authorize(mux)
+}
+
+// Require "Authorization: Bearer <api-token>" if the service was started with api-token
+// Browsers of the web UI send it as the password of basic auth instead, the username is recorded as operator
+func (s *Server) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("API_REQUEST: %s %s (%s)\n", r.Method, r.URL.Path, r.RemoteAddr)
+		token := s.config.CliArgs.ApiToken
+		if token != "" {
+			given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if _, password, ok := r.BasicAuth(); ok {
+				given = password
+			}
+			if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+				if !strings.HasPrefix(r.URL.Path, "/api/") {
+					w.Header().Set("WWW-Authenticate", `Basic realm="domjudge-interview"`)
+					http.Error(w, "Unauthorized", http.StatusUnauthorized)
+					return
+				}
+				writeJsonError(w, http.StatusUnauthorized, "API_UNAUTHORIZED: missing or wrong api token")
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) handleContests(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJsonError(w, http.StatusMethodNotAllowed, fmt.Sprintf("API_METHOD_ERR: %s not allowed", r.Method))
+		return
+	}
+	req, ok := readApiRequest(w, r)
+	if ok {
+		s.enqueueJob(w, "CREATE_CONTEST", req)
+	}
+}
+
+func (s *Server) handleContest(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/contests/"), "/"), "/")
+	route := r.Method + " " + strings.Join(parts[1:], "/")
+	op := map[string]string{
+		"DELETE ":           "DELETE_CONTEST",
+		"POST users":        "ADD_USERS",
+		"POST users/resend": "RESEND_EMAIL_USERS",
+		"POST users/delete": "DELETE_USERS",
+		"GET results":       "SHOW_RESULTS",
+	}[route]
+	if parts[0] == "" || op == "" {
+		writeJsonError(w, http.StatusNotFound, fmt.Sprintf("API_ROUTE_ERR: no route for %s %s", r.Method, r.URL.Path))
+		return
+	}
+	if op == "SHOW_RESULTS" {
+		s.writeResults(w, parts[0], getLastStr("json", r.URL.Query().Get("format")))
+		return
+	}
+	req, ok := readApiRequest(w, r)
+	if !ok {
+		return
+	}
+	req.ContestShortName = parts[0]
+	s.enqueueJob(w, op, req)
+}
+
+// Write results of a contest in one of resultsFormats to the response
+func (s *Server) writeResults(w http.ResponseWriter, contestShortName string, format string) {
+	if !resultsFormats[format] {
+		writeJsonError(w, http.StatusBadRequest, fmt.Sprintf("CLI_ARG_ERR: results-format arg %s must be one of tsv, csv, json, ndjson, markdown, html", format))
+		return
+	}
+	results, err := FetchContestResults(contestShortName, s.config)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if strings.Contains(err.Error(), "CONTEST_NOT_FOUND") {
+			status = http.StatusNotFound
+		}
+		writeJsonError(w, status, err.Error())
+		return
+	}
+	contentTypes := map[string]string{
+		"tsv":      "text/tab-separated-values; charset=utf-8",
+		"csv":      "text/csv; charset=utf-8",
+		"json":     "application/json",
+		"ndjson":   "application/x-ndjson",
+		"markdown": "text/markdown; charset=utf-8",
+		"html":     "text/html; charset=utf-8",
+	}
+	w.Header().Set("Content-Type", contentTypes[format])
+	if format != "json" && format != "html" {
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", contestShortName+".results."+format))
+	}
+	if err = WriteResults(w, format, true, results); err != nil {
+		log.Printf("RESULTS_WRITE_ERR: failed to write %s results of %s: %v\n", format, contestShortName, err)
+	}
+}
+
+func (s *Server) handleJobs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJsonError(w, http.StatusMethodNotAllowed, fmt.Sprintf("API_METHOD_ERR: %s not allowed", r.Method))
+		return
+	}
+	writeJson(w, http.StatusOK, s.ListJobs())
+}
+
+func (s *Server) handleJob(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/jobs/"), "/"), "/")
+	id, err := strconv.Atoi(parts[0])
+	if err != nil || r.Method != http.MethodGet || len(parts) > 2 || (len(parts) == 2 && parts[1] != "details") {
+		writeJsonError(w, http.StatusNotFound, fmt.Sprintf("API_ROUTE_ERR: no route for %s %s", r.Method, r.URL.Path))
+		return
+	}
+	job, ok := s.GetJob(id)
+	if !ok {
+		writeJsonError(w, http.StatusNotFound, fmt.Sprintf("JOB_NOT_FOUND: (id %d)", id))
+		return
+	}
+	if len(parts) == 1 {
+		writeJson(w, http.StatusOK, job)
+		return
+	}
+	if job.UsersFile == "" || (job.Status != "succeeded" && job.Status != "failed") {
+		writeJsonError(w, http.StatusNotFound, fmt.Sprintf("JOB_DETAILS_NOT_FOUND: (id %d, op %s, status %s)", id, job.Op, job.Status))
+		return
+	}
+	w.Header().Set("Content-Type", "text/tab-separated-values; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	http.ServeFile(w, r, job.UsersFile+".details")
+}
+
+// Validate a request for op and queue it as a job, the response is the queued job (202) or the validation error (400)
+func (s *Server) enqueueJob(w http.ResponseWriter, op string, req *ApiRequest) {
+	job, err := s.NewJob(op, req)
+	if err != nil {
+		writeJsonError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	w.Header().Set("Location", fmt.Sprintf("/api/jobs/%d", job.Id))
+	writeJson(w, http.StatusAccepted, job)
+}
+
+// Build the args of a job from the service args and a request, validate them like ValidateConfig does for the CLI
+// and queue the job. Users of users jobs are written to a users file in jobs-dir, as if given in users-file
+func (s *Server) NewJob(op string, req *ApiRequest) (job Job, err error) {
+	base := s.config.CliArgs
+	args := *base
+	args.Op = op
+	args.ContestName = getLastStr(base.ContestName, req.ContestName)
+	args.ContestShortName = req.ContestShortName
+	args.ContestDurationHours = getLastInt(base.ContestDurationHours, req.ContestDurationHours)
+	args.Problems = getLastStr(base.Problems, req.Problems)
+	args.StartTime = getLastStr(base.StartTime, req.StartTime)
+	args.FreezeBeforeEnd = getLastStr(base.FreezeBeforeEnd, req.FreezeBeforeEnd)
+	args.Timezone = getLastStr(base.Timezone, req.Timezone)
+	args.Category = getLastStr(base.Category, req.Category)
+	args.AffiliationShortName = getLastStr(base.AffiliationShortName, req.AffiliationShortName)
+	args.KeepSubmissions = req.KeepSubmissions
+	args.Operator = getLastStr(base.Operator, req.Operator)
+	args.UsersFile = ""
+	args.Journal = ""
+
+	// Ids are only used up by valid requests
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	id := s.nextId + 1
+	if op == "ADD_USERS" || op == "RESEND_EMAIL_USERS" || op == "DELETE_USERS" {
+		if len(req.Users) == 0 {
+			return job, PrintErr("CLI_ARG_ERR", "users missing")
+		}
+		args.UsersFile = filepath.Join(base.JobsDir, fmt.Sprintf("%d-%s.users.tsv", id, strings.ToLower(op)))
+		if err = writeUsersFile(args.UsersFile, req.Users); err != nil {
+			os.Remove(args.UsersFile)
+			return job, err
+		}
+	}
+	if err = ValidateConfig(&args); err != nil {
+		if args.UsersFile != "" {
+			os.Remove(args.UsersFile)
+		}
+		return job, err
+	}
+
+	newJob := &Job{Id: id, Op: op, Contest: args.ContestShortName, Operator: args.Operator, Status: "queued",
+		CreatedAt: time.Now(), UsersFile: args.UsersFile, args: &args}
+	select {
+	case s.queue <- newJob:
+	default:
+		if args.UsersFile != "" {
+			os.Remove(args.UsersFile)
+		}
+		return job, PrintErr("JOB_QUEUE_FULL", fmt.Sprintf("%d jobs are waiting to run, try again later", maxQueuedJobs))
+	}
+	s.nextId = id
+	s.jobs[id] = newJob
+	log.Printf("JOB_QUEUED: (id %d, op %s, contest %s, operator %s)\n", id, op, args.ContestShortName, args.Operator)
+	return *newJob, nil
+}
+
+// Status of a job
+func (s *Server) GetJob(id int) (job Job, ok bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.jobs[id] == nil {
+		return job, false
+	}
+	return *s.jobs[id], true
+}
+
+// Jobs, latest first
+func (s *Server) ListJobs() (jobs []Job) {
+	s.mutex.Lock()
+	jobs = make([]Job, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		jobs = append(jobs, *job)
+	}
+	s.mutex.Unlock()
+	sort.Slice(jobs, func(i, k int) bool { return jobs[i].Id > jobs[k].Id })
+	return jobs
+}
+
+// Run queued jobs one at a time, so that two jobs never change the same contest at once
+func (s *Server) runJobs() {
+	for job := range s.queue {
+		s.runJob(job)
+	}
+}
+
+// Run a job with a config of its own sharing the database connection, email sender and templates of the service
+func (s *Server) runJob(job *Job) {
+	s.updateJob(job, func() {
+		now := time.Now()
+		job.Status, job.StartedAt = "running", &now
+	})
+	log.Printf("JOB_START: (id %d, op %s, contest %s)\n", job.Id, job.Op, job.Contest)
+
+	loc, _ := time.LoadLocation(job.args.Timezone)
+	config := &Config{
+		CliArgs:        job.args,
+		Db:             s.config.Db,
+		Location:       loc,
+		EmailSender:    s.config.EmailSender,
+		EmailTemplates: s.config.EmailTemplates,
+	}
+	audit, err := NewAuditLog(job.args, s.config.Db, nil)
+	if err == nil {
+		config.Audit = audit
+		if job.Op == "DELETE_USERS" || job.Op == "DELETE_CONTEST" {
+			// Jobs of the same second on the same contest must not share a journal
+			journalFilename := filepath.Join(job.args.JobsDir, fmt.Sprintf("%d-%s", job.Id, DefaultJournalFilename(job.args.ContestShortName)))
+			if config.Journal, err = NewJournal(journalFilename, nil); err == nil {
+				s.updateJob(job, func() { job.Journal = journalFilename })
+			}
+		}
+	}
+	if err == nil {
+		err = PerformOp(config)
+	}
+	config.Journal.Close()
+
+	var users []UserDetails
+	var results []UserResult
+	if job.UsersFile != "" {
+		users = readUserDetails(job.UsersFile + ".details")
+		for i := range users {
+			users[i].Password = ""
+		}
+		results = readUserResults(job.UsersFile + ".results")
+	}
+	s.updateJob(job, func() {
+		now := time.Now()
+		job.Status, job.FinishedAt, job.Users, job.Results = "succeeded", &now, users, results
+		if err != nil {
+			job.Status, job.Error = "failed", strings.TrimSpace(err.Error())
+		}
+	})
+	log.Printf("JOB_END: (id %d, op %s, contest %s, status %s)\n", job.Id, job.Op, job.Contest, job.Status)
+}
+
+func (s *Server) updateJob(job *Job, update func()) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	update()
+}
+
+// Decode the JSON body of a request, an empty body is an empty request
+func readApiRequest(w http.ResponseWriter, r *http.Request) (req *ApiRequest, ok bool) {
+	req = new(ApiRequest)
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBytes))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(req); err != nil && err != io.EOF {
+		writeJsonError(w, http.StatusBadRequest, fmt.Sprintf("API_REQUEST_ERR: invalid JSON body: %v", err))
+		return nil, false
+	}
+	return req, true
+}
+
+// Write users of a request as a users file with a header row (see ReadUsersFile)
+func writeUsersFile(filename string, users []UserEntry) (err error) {
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return PrintErr("FILE_WOPEN_ERR", fmt.Sprintf("%s: %v", filename, err))
+	}
+	defer file.Close()
+	writer := csv.NewWriter(file)
+	writer.Comma = '\t'
+	writer.Write([]string{"email", "name", "team", "category", "affiliation", "room"})
+	for _, user := range users {
+		if strings.TrimSpace(user.Email) == "" {
+			return PrintErr("CLI_ARG_ERR", "users must all have an email")
+		}
+		category, affiliation, room := user.Category, user.Affiliation, ""
+		if user.CategoryId != 0 {
+			category = strconv.Itoa(user.CategoryId)
+		}
+		if user.AffilId != nil {
+			affiliation = strconv.Itoa(*user.AffilId)
+		}
+		if user.Room != nil {
+			room = *user.Room
+		}
+		writer.Write([]string{user.Email, user.Name, user.TeamName, category, affiliation, room})
+	}
+	writer.Flush()
+	if err = writer.Error(); err != nil {
+		return PrintErr("FILE_WRITE_ERR", fmt.Sprintf("%s: %v", filename, err))
+	}
+	return nil
+}
+
+// Read the user details file written by PerformOpOnFile, lines which can not be parsed are skipped
+func readUserDetails(filename string) (users []UserDetails) {
+	dat, err := ioutil.ReadFile(filename)
+	if err != nil {
+		log.Printf("USER_DETAILS_READ_ERR: %s: %v\n", filename, err)
+		return nil
+	}
+	for _, line := range strings.Split(string(dat), "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) != 4 || fields[0] == "email" {
+			continue
+		}
+		teamId, _ := strconv.Atoi(fields[3])
+		users = append(users, UserDetails{Email: fields[0], Username: fields[1], Password: fields[2], TeamId: teamId})
+	}
+	return users
+}
+
+// Read the results file written by PerformOpOnFile
+func readUserResults(filename string) (results []UserResult) {
+	dat, err := ioutil.ReadFile(filename)
+	if err != nil {
+		log.Printf("USER_RESULTS_READ_ERR: %s: %v\n", filename, err)
+		return nil
+	}
+	for _, line := range strings.Split(string(dat), "\n") {
+		fields := strings.SplitN(line, "\t", 2)
+		if len(fields) != 2 || line == "email\tresult" {
+			continue
+		}
+		results = append(results, UserResult{Email: fields[0], Result: fields[1]})
+	}
+	return results
+}
+
+func writeJson(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(v)
+}
+
+// Write an error in the format of PrintErr ("CODE: message") as {"error": ...}
+func writeJsonError(w http.ResponseWriter, status int, msg string) {
+	writeJson(w, status, map[string]string{"error": strings.TrimSpace(msg)})
+}
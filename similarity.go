@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	htmltemplate "html/template"
+	"log"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Number of tokens per shingle and fewest tokens a submission needs to be compared (tiny programs, e.g. reading
+// input and printing a constant, look alike no matter who wrote them)
+const (
+	shingleSize         = 5
+	similarityMinTokens = 30
+	reportMaxLines      = 400
+)
+
+// Keywords of C, C++, Java, Python, Go and JavaScript which are kept when identifiers are renamed
+var sourceKeywords = map[string]bool{}
+
+func init() {
+	for _, keyword := range strings.Fields(`auto break case catch char class const continue default delete do double else enum
+		extern false final finally float for friend goto if implements import include inline int interface long namespace new
+		null nullptr operator package private protected public register return short signed sizeof static struct super switch
+		template this throw throws true try typedef typename union unsigned using virtual void volatile while and as assert
+		async await def del elif except from global in is lambda None nonlocal not or pass raise True False with yield chan
+		defer fallthrough func go map range select type var let function undefined typeof instanceof bool boolean string
+		vector std cin cout endl printf scanf print input len`) {
+		sourceKeywords[keyword] = true
+	}
+}
+
+// Suspiciously similar pair of submissions of two candidates for one problem
+type SimilarPair struct {
+	Problem    string
+	Similarity float64
+	Left       SubmissionExport
+	Right      SubmissionExport
+	LeftLines  []ReportLine
+	RightLines []ReportLine
+}
+
+// Line of source code in a similarity report, Same is set if the other submission has the same normalized line
+type ReportLine struct {
+	Text string
+	Same bool
+}
+
+// Compare latest correct (or latest) submission of every candidate for every problem of a contest with those of
+// the other candidates, print pairs at least threshold similar as TSV to stdout and write an HTML report with their
+// sources side by side to reportFile. Similarity is the Jaccard index of token shingles after normalizing the
+// sources (comments and whitespace removed, identifiers, numbers and strings renamed), so renaming variables or
+// reformatting does not hide a copy. Runs offline on sources in DOMJudge database
+func SimilarityReport(contestShortName string, threshold float64, reportFile string, config *Config) (err error) {
+	_, submissions, files, err := FetchContestSubmissions(contestShortName, config)
+	if err != nil {
+		return err
+	}
+
+	// Pick one submission per team and problem: the latest correct one, the latest one otherwise
+	picked := make(map[string]map[int]SubmissionExport)
+	for _, submission := range submissions {
+		if picked[submission.Problem] == nil {
+			picked[submission.Problem] = make(map[int]SubmissionExport)
+		}
+		current, ok := picked[submission.Problem][submission.TeamId]
+		if !ok || current.Verdict != "correct" || submission.Verdict == "correct" {
+			picked[submission.Problem][submission.TeamId] = submission
+		}
+	}
+
+	var pairs []SimilarPair
+	compared := 0
+	for problem, teamSubmissions := range picked {
+		type candidate struct {
+			submission SubmissionExport
+			source     string
+			shingles   map[uint64]bool
+		}
+		var candidates []candidate
+		for _, submission := range teamSubmissions {
+			source := submissionSource(files[submission.SubmitId])
+			tokens := NormalizeSource(source)
+			if len(tokens) < similarityMinTokens {
+				continue
+			}
+			candidates = append(candidates, candidate{submission, source, TokenShingles(tokens, shingleSize)})
+		}
+		sort.Slice(candidates, func(i, k int) bool { return candidates[i].submission.SubmitId < candidates[k].submission.SubmitId })
+		for i := 0; i < len(candidates); i++ {
+			for k := i + 1; k < len(candidates); k++ {
+				compared++
+				similarity := JaccardSimilarity(candidates[i].shingles, candidates[k].shingles)
+				if similarity < threshold {
+					continue
+				}
+				leftLines, rightLines := markSameLines(candidates[i].source, candidates[k].source)
+				pairs = append(pairs, SimilarPair{Problem: problem, Similarity: similarity, Left: candidates[i].submission,
+					Right: candidates[k].submission, LeftLines: leftLines, RightLines: rightLines})
+			}
+		}
+	}
+	sort.Slice(pairs, func(i, k int) bool {
+		if pairs[i].Similarity != pairs[k].Similarity {
+			return pairs[i].Similarity > pairs[k].Similarity
+		}
+		return pairs[i].Left.SubmitId < pairs[k].Left.SubmitId
+	})
+	log.Printf("SIMILARITY_REPORT: (contestshortname: %s, compared pairs: %d, similar pairs: %d, threshold: %.2f)\n", contestShortName, compared, len(pairs), threshold)
+
+	fmt.Printf("problem\tsimilarity\temail1\tsubmitid1\temail2\tsubmitid2\n")
+	for _, pair := range pairs {
+		fmt.Printf("%s\t%.2f\t%s\t%d\t%s\t%d\n", pair.Problem, pair.Similarity, pair.Left.Email, pair.Left.SubmitId, pair.Right.Email, pair.Right.SubmitId)
+	}
+
+	var buf bytes.Buffer
+	data := map[string]interface{}{
+		"Contest":     contestShortName,
+		"GeneratedAt": time.Now(),
+		"Threshold":   threshold,
+		"Compared":    compared,
+		"Pairs":       pairs,
+	}
+	if err = similarityHtmlTemplate.Execute(&buf, data); err != nil {
+		return PrintErr("SIMILARITY_REPORT_RENDER_ERR", fmt.Sprintf("%v", err))
+	}
+	return writeExportFile(reportFile, buf.Bytes(), config)
+}
+
+// Source of a submission, files of multi file submissions are concatenated
+func submissionSource(files []SubmissionFile) string {
+	if len(files) == 1 {
+		return files[0].Source
+	}
+	var sb strings.Builder
+	for _, file := range files {
+		fmt.Fprintf(&sb, "// ==== %s ====\n%s\n", file.Filename, file.Source)
+	}
+	return sb.String()
+}
+
+// Tokenize source code of any of the usual contest languages into a normalized token stream:
+// comments (//, #, /* */) and whitespace are dropped, identifiers other than keywords become V, numbers N and
+// string/char literals S
+func NormalizeSource(source string) (tokens []string) {
+	runes := []rune(source)
+	n := len(runes)
+	for i := 0; i < n; {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '/' && i+1 < n && runes[i+1] == '/', r == '#':
+			for i < n && runes[i] != '\n' {
+				i++
+			}
+		case r == '/' && i+1 < n && runes[i+1] == '*':
+			i += 2
+			for i < n && !(runes[i] == '*' && i+1 < n && runes[i+1] == '/') {
+				i++
+			}
+			i += 2
+		case r == '"' || r == '\'' || r == '`':
+			// Python triple quoted strings end at the next triple quote
+			if i+2 < n && runes[i+1] == r && runes[i+2] == r {
+				i += 3
+				for i < n && !(runes[i] == r && i+2 < n && runes[i+1] == r && runes[i+2] == r) {
+					i++
+				}
+				i += 3
+			} else {
+				i++
+				for i < n && runes[i] != r && (runes[i] != '\n' || r == '`') {
+					if runes[i] == '\\' {
+						i++
+					}
+					i++
+				}
+				i++
+			}
+			tokens = append(tokens, "S")
+		case unicode.IsDigit(r):
+			for i < n && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) || runes[i] == '.' || runes[i] == '_') {
+				i++
+			}
+			tokens = append(tokens, "N")
+		case unicode.IsLetter(r) || r == '_':
+			start := i
+			for i < n && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) || runes[i] == '_') {
+				i++
+			}
+			word := string(runes[start:i])
+			if sourceKeywords[word] {
+				tokens = append(tokens, word)
+			} else {
+				tokens = append(tokens, "V")
+			}
+		default:
+			tokens = append(tokens, string(r))
+			i++
+		}
+	}
+	return tokens
+}
+
+// Hashes of all runs of size consecutive tokens
+func TokenShingles(tokens []string, size int) map[uint64]bool {
+	shingles := make(map[uint64]bool)
+	for i := 0; i+size <= len(tokens); i++ {
+		h := fnv.New64a()
+		for _, token := range tokens[i : i+size] {
+			h.Write([]byte(token))
+			h.Write([]byte{0})
+		}
+		shingles[h.Sum64()] = true
+	}
+	return shingles
+}
+
+// Jaccard index of two shingle sets: shared shingles / all shingles
+func JaccardSimilarity(a map[uint64]bool, b map[uint64]bool) float64 {
+	if len(a) == 0 && len(b) == 0 {
+		return 0
+	}
+	shared := 0
+	for shingle := range a {
+		if b[shingle] {
+			shared++
+		}
+	}
+	return float64(shared) / float64(len(a)+len(b)-shared)
+}
+
+// Split both sources into at most reportMaxLines lines, marking lines whose normalized form (of at least 3 tokens)
+// also appears in the other source
+func markSameLines(left string, right string) (leftLines []ReportLine, rightLines []ReportLine) {
+	normalizedLines := func(source string) (lines []string, normalized map[string]bool) {
+		lines = strings.Split(strings.Replace(source, "\r\n", "\n", -1), "\n")
+		if len(lines) > reportMaxLines {
+			lines = append(lines[:reportMaxLines], fmt.Sprintf("... %d more lines", len(lines)-reportMaxLines))
+		}
+		normalized = make(map[string]bool)
+		for _, line := range lines {
+			if tokens := NormalizeSource(line); len(tokens) >= 3 {
+				normalized[strings.Join(tokens, " ")] = true
+			}
+		}
+		return lines, normalized
+	}
+	leftSource, leftNormalized := normalizedLines(left)
+	rightSource, rightNormalized := normalizedLines(right)
+	mark := func(lines []string, other map[string]bool) (reportLines []ReportLine) {
+		for _, line := range lines {
+			tokens := NormalizeSource(line)
+			reportLines = append(reportLines, ReportLine{Text: line, Same: len(tokens) >= 3 && other[strings.Join(tokens, " ")]})
+		}
+		return reportLines
+	}
+	return mark(leftSource, rightNormalized), mark(rightSource, leftNormalized)
+}
+
+// Self-contained similarity report (no external CSS or scripts)
+var similarityHtmlTemplate = htmltemplate.Must(htmltemplate.New("similarity").Funcs(htmltemplate.FuncMap{
+	"percent": func(f float64) string { return fmt.Sprintf("%.0f%%", f*100) },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Similarity report: {{.Contest}}</title>
+<style>
+body { font-family: -apple-system, "Segoe UI", Helvetica, Arial, sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; vertical-align: top; }
+table.sources { width: 100%; table-layout: fixed; }
+pre { margin: 0; font-size: 12px; white-space: pre-wrap; word-break: break-all; }
+span.same { background: #ffe08a; display: block; }
+span.diff { display: block; }
+h2 { margin-top: 2em; }
+.meta { color: #666; }
+</style>
+</head>
+<body>
+<h1>Similarity report: {{.Contest}}</h1>
+<p class="meta">Generated {{.GeneratedAt.Format "2006-01-02 15:04:05 MST"}}. {{.Compared}} pairs of submissions compared,
+{{len .Pairs}} at least {{percent .Threshold}} similar. Highlighted lines are the same in both submissions after
+renaming identifiers, numbers and strings.</p>
+{{if .Pairs}}<table>
+<tr><th>problem</th><th>similarity</th><th>candidate 1</th><th>candidate 2</th></tr>
+{{range $i, $p := .Pairs}}<tr><td>{{$p.Problem}}</td><td><a href="#pair{{$i}}">{{percent $p.Similarity}}</a></td><td>{{$p.Left.Email}} (s{{$p.Left.SubmitId}}, {{$p.Left.Verdict}})</td><td>{{$p.Right.Email}} (s{{$p.Right.SubmitId}}, {{$p.Right.Verdict}})</td></tr>
+{{end}}</table>{{end}}
+{{range $i, $p := .Pairs}}<h2 id="pair{{$i}}">Problem {{$p.Problem}}: {{percent $p.Similarity}} similar</h2>
+<table class="sources">
+<tr><th>{{$p.Left.Email}} &middot; submission {{$p.Left.SubmitId}} &middot; {{$p.Left.LangId}} &middot; {{$p.Left.Verdict}} &middot; minute {{$p.Left.ContestTime}}</th>
+<th>{{$p.Right.Email}} &middot; submission {{$p.Right.SubmitId}} &middot; {{$p.Right.LangId}} &middot; {{$p.Right.Verdict}} &middot; minute {{$p.Right.ContestTime}}</th></tr>
+<tr><td><pre>{{range $p.LeftLines}}<span class="{{if .Same}}same{{else}}diff{{end}}">{{.Text}} </span>{{end}}</pre></td>
+<td><pre>{{range $p.RightLines}}<span class="{{if .Same}}same{{else}}diff{{end}}">{{.Text}} </span>{{end}}</pre></td></tr>
+</table>
+{{end}}
+</body>
+</html>
+`))
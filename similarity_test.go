@@ -0,0 +1,105 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeSource(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{"identifiers and numbers", "int total = 42;", "int V = N ;"},
+		{"keywords are kept", "for (int i = 0; i < n; i++) return i;", "for ( int V = N ; V < V ; V + + ) return V ;"},
+		{"line comments", "x = 1 // set x\n# python comment\ny = 2", "V = N V = N"},
+		{"block comments", "a /* one\ntwo */ b", "V V"},
+		{"string and char literals", `print("a \"b\" c", 'x')`, "print ( S , S )"},
+		{"python triple quoted strings", "s = \"\"\"multi\nline \" quote\"\"\"\nt = 1", "V = S V = N"},
+		{"go raw strings span lines", "s := `a\nb`", "V : = S"},
+		{"numbers with suffixes", "x = 1.5e3 + 0x1F + 10LL", "V = N + N + N"},
+		{"unterminated comment", "a /* never closed", "V"},
+		{"empty", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := strings.Join(NormalizeSource(tt.source), " "); got != tt.want {
+				t.Errorf("NormalizeSource(%q) = %q, want %q", tt.source, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSimilarity(t *testing.T) {
+	original := `#include <iostream>
+int main() {
+	int n, sum = 0;
+	std::cin >> n;
+	for (int i = 1; i <= n; i++) {
+		if (i % 3 == 0 || i % 5 == 0) sum += i;
+	}
+	std::cout << sum << std::endl;
+	return 0;
+}`
+	// Same program with renamed variables, other constants, comments and layout
+	renamed := `#include <iostream>
+// my solution
+int main()
+{
+	int count, total = 0;   /* accumulator */
+	std::cin >> count;
+	for (int k = 1; k <= count; k++)
+	{
+		if (k % 7 == 0 || k % 11 == 0) total += k;
+	}
+	std::cout << total << std::endl;
+	return 0;
+}`
+	different := `n = int(input())
+print(sum(x for x in range(1, n + 1) if x % 3 == 0 or x % 5 == 0))`
+
+	tests := []struct {
+		name string
+		a, b string
+		min  float64
+		max  float64
+	}{
+		{"identical", original, original, 1, 1},
+		{"renamed and reformatted", original, renamed, 1, 1},
+		{"different language and approach", original, different, 0, 0.2},
+		{"both too short for a shingle", "x", "y", 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := TokenShingles(NormalizeSource(tt.a), shingleSize)
+			b := TokenShingles(NormalizeSource(tt.b), shingleSize)
+			got := JaccardSimilarity(a, b)
+			if got < tt.min || got > tt.max {
+				t.Errorf("JaccardSimilarity = %.3f, want between %.2f and %.2f", got, tt.min, tt.max)
+			}
+			if back := JaccardSimilarity(b, a); math.Abs(back-got) > 1e-9 {
+				t.Errorf("JaccardSimilarity is not symmetric: %.3f and %.3f", got, back)
+			}
+		})
+	}
+}
+
+func TestTokenShingles(t *testing.T) {
+	tokens := strings.Fields("V = N ; V = N ;")
+	tests := []struct {
+		size int
+		want int
+	}{
+		{1, 4}, // V, =, N and ;
+		{4, 4}, // every rotation of "V = N ;", the last run repeats the first
+		{8, 1}, // the whole stream
+		{9, 0}, // longer than the stream
+	}
+	for _, tt := range tests {
+		if got := len(TokenShingles(tokens, tt.size)); got != tt.want {
+			t.Errorf("TokenShingles(size %d) has %d shingles, want %d", tt.size, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Submission of a contest with its latest judging verdict, as written to the manifest of EXPORT_SUBMISSIONS
+type SubmissionExport struct {
+	SubmitId    int      `json:"submitid"`
+	TeamId      int      `json:"teamid"`
+	Email       string   `json:"email"`
+	Username    string   `json:"username"`
+	Problem     string   `json:"problem"`
+	ProbId      int      `json:"probid"`
+	LangId      string   `json:"langid"`
+	SubmitTime  string   `json:"submittime"`
+	ContestTime int      `json:"contest_minute"`
+	JudgingId   int      `json:"judgingid,omitempty"`
+	Verdict     string   `json:"verdict"`
+	Files       []string `json:"files"`
+}
+
+// Manifest of an exported contest, written to manifest.json at the root of output-dir
+type SubmissionsManifest struct {
+	Contest     string             `json:"contest"`
+	Cid         int                `json:"cid"`
+	GeneratedAt time.Time          `json:"generated_at"`
+	Submissions []SubmissionExport `json:"submissions"`
+}
+
+// Source file of a submission
+type SubmissionFile struct {
+	Filename string
+	Source   string
+}
+
+// Fetch every submission of a contest with its latest valid judging verdict (pending if not judged yet), the user of
+// its team and its source files (submitid -> files in rank order). Submissions the jury ignored (valid = 0) are left out
+func FetchContestSubmissions(contestShortName string, config *Config) (contest Contest, submissions []SubmissionExport, files map[int][]SubmissionFile, err error) {
+	contest, err = GetContestByShortName(contestShortName, config)
+	if err != nil {
+		return contest, nil, nil, err
+	}
+	if contest.Name == "" || contest.Cid == 0 {
+		return contest, nil, nil, PrintErr("CONTEST_NOT_FOUND", fmt.Sprintf("contestshortname: %s", contestShortName))
+	}
+	loc := GetContestLocation(contest, config.Location)
+
+	problems, err := GetContestProblems(contest.Cid, config.Db)
+	if err != nil {
+		return contest, nil, nil, err
+	}
+	problemNames := make(map[int]string)
+	for _, problem := range problems {
+		problemNames[problem.ProbId] = problem.ShortName
+	}
+
+	// 1. Read submissions
+	sqlQuery := `SELECT submitid, teamid, probid, langid, submittime FROM submission WHERE cid = ? AND valid = 1 ORDER BY submitid`
+	rows, err := config.Db.Raw(sqlQuery, contest.Cid).Rows()
+	if err != nil {
+		return contest, nil, nil, PrintErr("READ_SUBMISSIONS_ERR", fmt.Sprintf("contestshortname: %s): %v", contestShortName, err))
+	}
+	index := make(map[int]int)
+	var teamIds []int
+	for rows.Next() {
+		var submission SubmissionExport
+		var submitTime float64
+		if err = rows.Scan(&submission.SubmitId, &submission.TeamId, &submission.ProbId, &submission.LangId, &submitTime); err != nil {
+			rows.Close()
+			return contest, nil, nil, PrintErr("FETCH_SUBMISSION_ERR", fmt.Sprintf("contestshortname: %s): %v", contestShortName, err))
+		}
+		submission.SubmitTime = FormatContestTime(submitTime, loc)
+		submission.ContestTime = int((submitTime - contest.StartTime) / 60)
+		submission.Problem = problemNames[submission.ProbId]
+		if submission.Problem == "" {
+			submission.Problem = strconv.Itoa(submission.ProbId)
+		}
+		submission.Verdict = "pending"
+		index[submission.SubmitId] = len(submissions)
+		submissions = append(submissions, submission)
+		teamIds = append(teamIds, submission.TeamId)
+	}
+	rows.Close()
+	log.Printf("CONTEST_SUBMISSIONS: (contestshortname: %s, submissions: %d)\n", contestShortName, len(submissions))
+
+	// 2. Latest valid judging of every submission
+	sqlQuery = `SELECT judgingid, submitid, result FROM judging WHERE cid = ? AND valid = 1 ORDER BY judgingid`
+	rows, err = config.Db.Raw(sqlQuery, contest.Cid).Rows()
+	if err != nil {
+		return contest, nil, nil, PrintErr("READ_JUDGINGS_ERR", fmt.Sprintf("contestshortname: %s): %v", contestShortName, err))
+	}
+	for rows.Next() {
+		var judgingId, submitId int
+		var result *string
+		if err = rows.Scan(&judgingId, &submitId, &result); err != nil {
+			rows.Close()
+			return contest, nil, nil, PrintErr("FETCH_JUDGING_ERR", fmt.Sprintf("contestshortname: %s): %v", contestShortName, err))
+		}
+		if i, ok := index[submitId]; ok {
+			submissions[i].JudgingId = judgingId
+			submissions[i].Verdict = "pending"
+			if result != nil && *result != "" {
+				submissions[i].Verdict = *result
+			}
+		}
+	}
+	rows.Close()
+
+	// 3. Users of teams
+	teamUsers, err := GetTeamUsers(teamIds, config)
+	if err != nil {
+		return contest, nil, nil, err
+	}
+	for i := range submissions {
+		if user, ok := teamUsers[submissions[i].TeamId]; ok {
+			submissions[i].Email, submissions[i].Username = user.Email, user.Username
+		}
+	}
+
+	// 4. Source files
+	sqlQuery = `SELECT f.submitid, f.filename, f.sourcecode FROM submission_file f JOIN submission s ON s.submitid = f.submitid
+		WHERE s.cid = ? AND s.valid = 1 ORDER BY f.submitid, f.rank`
+	files = make(map[int][]SubmissionFile)
+	rows, err = config.Db.Raw(sqlQuery, contest.Cid).Rows()
+	if err != nil {
+		return contest, nil, nil, PrintErr("READ_SUBMISSION_FILES_ERR", fmt.Sprintf("contestshortname: %s): %v", contestShortName, err))
+	}
+	for rows.Next() {
+		var submitId int
+		var filename string
+		var sourceCode []byte
+		if err = rows.Scan(&submitId, &filename, &sourceCode); err != nil {
+			rows.Close()
+			return contest, nil, nil, PrintErr("FETCH_SUBMISSION_FILE_ERR", fmt.Sprintf("contestshortname: %s): %v", contestShortName, err))
+		}
+		files[submitId] = append(files[submitId], SubmissionFile{Filename: filename, Source: string(sourceCode)})
+	}
+	rows.Close()
+	return contest, submissions, files, nil
+}
+
+// Export source code of every submission of a contest to outputDir as <email>/<problem>/<submitid>-<verdict>.<ext>
+// (<submitid>-<verdict>/<filename> for submissions of several files) along with manifest.json
+// Submissions of teams without a user are exported under the team id
+func ExportSubmissions(contestShortName string, outputDir string, config *Config) (err error) {
+	contest, submissions, files, err := FetchContestSubmissions(contestShortName, config)
+	if err != nil {
+		return err
+	}
+
+	for i := range submissions {
+		submission := &submissions[i]
+		owner := submission.Email
+		if owner == "" {
+			owner = fmt.Sprintf("team-%d", submission.TeamId)
+		}
+		dir := filepath.Join(outputDir, safePathName(owner), safePathName(submission.Problem))
+		name := fmt.Sprintf("%d-%s", submission.SubmitId, safePathName(submission.Verdict))
+		submissionFiles := files[submission.SubmitId]
+		for _, file := range submissionFiles {
+			ext := path.Ext(file.Filename)
+			if ext == "" {
+				ext = "." + safePathName(submission.LangId)
+			}
+			filePath := filepath.Join(dir, name+ext)
+			if len(submissionFiles) > 1 {
+				filePath = filepath.Join(dir, name, safePathName(file.Filename))
+			}
+			if err = writeExportFile(filePath, []byte(file.Source), config); err != nil {
+				return err
+			}
+			relPath, _ := filepath.Rel(outputDir, filePath)
+			submission.Files = append(submission.Files, filepath.ToSlash(relPath))
+		}
+	}
+
+	manifest := SubmissionsManifest{Contest: contestShortName, Cid: contest.Cid, GeneratedAt: time.Now(), Submissions: submissions}
+	data, _ := json.MarshalIndent(manifest, "", "  ")
+	if err = writeExportFile(filepath.Join(outputDir, "manifest.json"), data, config); err != nil {
+		return err
+	}
+	log.Printf("EXPORT_SUBMISSIONS_SUCCESS: (contestshortname: %s, submissions: %d, dir: %s)\n", contestShortName, len(submissions), outputDir)
+	return nil
+}
+
+// Write an exported file creating its directory, in dry run mode the file only goes to the plan
+func writeExportFile(filePath string, data []byte, config *Config) (err error) {
+	if config.Plan != nil {
+		config.Plan.Add("WRITE_FILE", fmt.Sprintf("%s (%d bytes)", filePath, len(data)))
+		return nil
+	}
+	if err = os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return PrintErr("EXPORT_MKDIR_ERR", fmt.Sprintf("%s: %v", filePath, err))
+	}
+	if err = ioutil.WriteFile(filePath, data, 0644); err != nil {
+		return PrintErr("EXPORT_WRITE_ERR", fmt.Sprintf("%s: %v", filePath, err))
+	}
+	return nil
+}
+
+// Make a single path element out of an email, problem name, verdict or submitted filename
+func safePathName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == 0 || r < ' ' {
+			return '_'
+		}
+		return r
+	}, strings.TrimSpace(name))
+	name = strings.TrimLeft(name, ".")
+	if name == "" {
+		return "_"
+	}
+	return name
+}
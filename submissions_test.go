@@ -0,0 +1,39 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestSafePathName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"jane@x.com", "jane@x.com"},
+		{"main.cpp", "main.cpp"},
+		{"  Hello World  ", "Hello World"},
+		{"../../etc/passwd", "_.._etc_passwd"},
+		{"..\\..\\windows\\win.ini", "_.._windows_win.ini"},
+		{"/etc/passwd", "_etc_passwd"},
+		{"..", "_"},
+		{".", "_"},
+		{".bashrc", "bashrc"},
+		{"", "_"},
+		{"a\x00b\nc\td", "a_b_c_d"},
+		{"WRONG-ANSWER", "WRONG-ANSWER"},
+	}
+	dir := filepath.Join("export", "jane@x.com")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := safePathName(tt.name)
+			if got != tt.want {
+				t.Errorf("safePathName(%q) = %q, want %q", tt.name, got, tt.want)
+			}
+			// Joined to an export directory it must stay a single element inside it
+			if joined := filepath.Join(dir, got); filepath.Dir(joined) != dir {
+				t.Errorf("safePathName(%q) = %q escapes %s as %s", tt.name, got, dir, joined)
+			}
+		})
+	}
+}
@@ -1,29 +1,83 @@
 package main
 
-import "github.com/jinzhu/gorm"
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
 
 // Command line arguments to control this service
-// Supported values for op: CREATE_CONTEST, ADD_USERS, DELETE_USERS, SHOW_RESULTS, START_CONTEST, END_CONTEST, FREEZE_CONTEST, UNFREEZE_CONTEST
+// Supported values for op: CREATE_CONTEST, CLONE_CONTEST, ADD_USERS, RESEND_EMAIL_USERS, DELETE_USERS, DELETE_CONTEST, SHOW_RESULTS, START_CONTEST, END_CONTEST, FREEZE_CONTEST, UNFREEZE_CONTEST,
+// CREATE_AFFILIATION, LIST_AFFILIATIONS, DELETE_AFFILIATION, CREATE_CATEGORY, LIST_CATEGORIES, SHOW_AUDIT, RESTORE,
+// EXPORT_SUBMISSIONS, SIMILARITY_REPORT, CANDIDATE_REPORT, SERVE
 type CliArgs struct {
-	Op                   string `json:"op"`
-	ContestName          string `json:"contest-name"`
-	ContestShortName     string `json:"contest-short-name"`
-	ContestDurationHours int    `json:"contest-duration-hours"`
-	UsersFile            string `json:"users-file"`
-	ResultsFile          string `json:"results-file"`
-	DbConnStr            string `json:"db-conn-str"`
-	SendwithusApiKey     string `json:"sendwithus-api-key"`
-	SendwithusTemplateId string `json:"sendwithus-template-id"`
-	SendwithusReplyTo    string `json:"sendwithus-reply-to"`
-	SendwithusFrom       string `json:"sendwithus-from"`
-	SendwithusFromName   string `json:"sendwithus-from-name"`
-	SendwithusCc         string `json:"sendwithus-cc"`
-	ContestUrl           string `json:"contest-url"`
+	Op                   string  `json:"op"`
+	ContestName          string  `json:"contest-name"`
+	ContestShortName     string  `json:"contest-short-name"`
+	ContestDurationHours int     `json:"contest-duration-hours"`
+	From                 string  `json:"from"`
+	Category             string  `json:"category"`
+	CategoryName         string  `json:"category-name"`
+	CategorySortOrder    int     `json:"category-sortorder"`
+	CategoryColor        string  `json:"category-color"`
+	CategoryHidden       bool    `json:"category-hidden"`
+	AffiliationShortName string  `json:"affiliation-short-name"`
+	AffiliationName      string  `json:"affiliation-name"`
+	AffiliationCountry   string  `json:"affiliation-country"`
+	Problems             string  `json:"problems"`
+	StartTime            string  `json:"start-time"`
+	FreezeBeforeEnd      string  `json:"freeze-before-end"`
+	Timezone             string  `json:"timezone"`
+	UsersFile            string  `json:"users-file"`
+	Concurrency          int     `json:"concurrency"`
+	UsernameScheme       string  `json:"username-scheme"`
+	UsernamePrefix       string  `json:"username-prefix"`
+	ResultsFile          string  `json:"results-file"`
+	ResultsFormat        string  `json:"results-format"`
+	Append               bool    `json:"append"`
+	OutputDir            string  `json:"output-dir"`
+	ReportFile           string  `json:"report-file"`
+	ReportFormat         string  `json:"report-format"`
+	Listen               string  `json:"listen"`
+	ApiToken             string  `json:"api-token"`
+	JobsDir              string  `json:"jobs-dir"`
+	SimilarityThreshold  float64 `json:"similarity-threshold"`
+	DbConnStr            string  `json:"db-conn-str"`
+	SendwithusApiKey     string  `json:"sendwithus-api-key"`
+	SendwithusTemplateId string  `json:"sendwithus-template-id"`
+	SendwithusReplyTo    string  `json:"sendwithus-reply-to"`
+	SendwithusFrom       string  `json:"sendwithus-from"`
+	SendwithusFromName   string  `json:"sendwithus-from-name"`
+	SendwithusCc         string  `json:"sendwithus-cc"`
+	EmailBackend         string  `json:"email-backend"`
+	SmtpHost             string  `json:"smtp-host"`
+	SmtpPort             int     `json:"smtp-port"`
+	SmtpUsername         string  `json:"smtp-username"`
+	SmtpPassword         string  `json:"smtp-password"`
+	SmtpSkipStartTls     bool    `json:"smtp-skip-starttls"`
+	EmailDir             string  `json:"email-dir"`
+	EmailTemplatesDir    string  `json:"email-templates-dir"`
+	Preview              bool    `json:"preview"`
+	DryRun               bool    `json:"dry-run"`
+	AuditFile            string  `json:"audit-file"`
+	AuditTable           bool    `json:"audit-table"`
+	Operator             string  `json:"operator"`
+	Email                string  `json:"email"`
+	Journal              string  `json:"journal"`
+	KeepSubmissions      bool    `json:"keep-submissions"`
+	ContestUrl           string  `json:"contest-url"`
 }
 
 type Config struct {
-	CliArgs *CliArgs `json:"cli_args"`
-	Db      *gorm.DB `json:"db"`
+	CliArgs     *CliArgs       `json:"cli_args"`
+	Db          *gorm.DB       `json:"db"`
+	Location    *time.Location `json:"-"`
+	EmailSender EmailSender    `json:"-"`
+
+	EmailTemplates *WelcomeEmailTemplates `json:"-"`
+	Plan           *DryRunPlan            `json:"-"`
+	Audit          *AuditLog              `json:"-"`
+	Journal        *Journal               `json:"-"`
 }
 
 type Contest struct {
@@ -46,7 +100,27 @@ type Contest struct {
 	Enabled              int     `json:"enabled" gorm:"column:enabled;"`
 	Public               int     `json:"public" gorm:"column:public;"`
 
-	DurationHours int `json:"contest-duration-hours" gorm:"-"`
+	DurationHours int              `json:"contest-duration-hours" gorm:"-"`
+	Problems      []ContestProblem `json:"problems" gorm:"-"`
+}
+
+type Problem struct {
+	ProbId     int     `json:"probid" gorm:"column:probid;PRIMARY_KEY;"`
+	ExternalId *string `json:"externalid" gorm:"column:externalid;UNIQUE;"`
+	Name       string  `json:"name" gorm:"column:name;"`
+	TimeLimit  float64 `json:"timelimit" gorm:"column:timelimit;"`
+}
+
+type ContestProblem struct {
+	Cid         int     `json:"cid" gorm:"column:cid;PRIMARY_KEY;"`
+	ProbId      int     `json:"probid" gorm:"column:probid;PRIMARY_KEY;"`
+	ShortName   string  `json:"shortname" gorm:"column:shortname;"`
+	Points      int     `json:"points" gorm:"column:points;"`
+	AllowSubmit int     `json:"allow_submit" gorm:"column:allow_submit;"`
+	AllowJudge  int     `json:"allow_judge" gorm:"column:allow_judge;"`
+	Color       *string `json:"color" gorm:"column:color;"`
+
+	ProblemRef string `json:"problem" gorm:"-"`
 }
 
 type Team struct {
@@ -63,6 +137,23 @@ type Team struct {
 	Penalty            int      `json:"penalty" gorm:"column:penalty"`
 }
 
+type TeamAffiliation struct {
+	AffilId    int     `json:"affilid" gorm:"column:affilid;PRIMARY_KEY;"`
+	ExternalId *string `json:"externalid" gorm:"column:externalid;UNIQUE;"`
+	ShortName  string  `json:"shortname" gorm:"column:shortname;"`
+	Name       string  `json:"name" gorm:"column:name;"`
+	Country    *string `json:"country" gorm:"column:country;"`
+	Comments   *string `json:"comments" gorm:"column:comments;"`
+}
+
+type TeamCategory struct {
+	CategoryId int     `json:"categoryid" gorm:"column:categoryid;PRIMARY_KEY;"`
+	Name       string  `json:"name" gorm:"column:name;"`
+	SortOrder  int     `json:"sortorder" gorm:"column:sortorder;"`
+	Color      *string `json:"color" gorm:"column:color;"`
+	Visible    int     `json:"visible" gorm:"column:visible;"`
+}
+
 type User struct {
 	UserId        int      `json:"userid" gorm:"column:userid;PRIMARY_KEY;"`
 	Username      string   `json:"username" gorm:"column:username;UNIQUE"`
@@ -77,6 +168,18 @@ type User struct {
 	TeamId        int      `json:"teamid" gorm:"column:teamid"`
 }
 
+// One row of the users file
+type UserEntry struct {
+	Email       string  `json:"email"`
+	Name        string  `json:"name"`
+	TeamName    string  `json:"team_name"`
+	CategoryId  int     `json:"categoryid"`
+	Category    string  `json:"category"`
+	AffilId     *int    `json:"affilid"`
+	Affiliation string  `json:"affiliation"`
+	Room        *string `json:"room"`
+}
+
 type UserRole struct {
 	UserId int `json:"userid" gorm:"column:userid;"`
 	RoleId int `json:"roleid" gorm:"column:roleid;"`
@@ -87,6 +190,18 @@ type TeamScore struct {
 	TeamId    int   `json:"teamid" gorm:"column:teamid;"`
 	Points    int   `json:"points_restricted" gorm:"column:points_restricted;"`
 	TimeTaken int64 `json:"totaltime_restricted" gorm:"column:totaltime_restricted;"`
+
+	Problems []ProblemScore `json:"problems" gorm:"-"`
+}
+
+// Score of a team for one problem of a contest (from scorecache, like a cell of DOMJudge scoreboard)
+type ProblemScore struct {
+	ShortName   string `json:"shortname"`
+	ProbId      int    `json:"probid"`
+	Solved      bool   `json:"solved"`
+	Submissions int    `json:"submissions"`
+	Pending     int    `json:"pending"`
+	Time        int    `json:"time"`
 }
 
 type ContestTeam struct {
@@ -95,12 +210,15 @@ type ContestTeam struct {
 }
 
 type ContestWelcomeEmail struct {
-	ContestUrl       string `json:"contest_url"`
-	Deadline         string `json:"deadline"`
-	FirstName        string `json:"first_name"`
-	Title            string `json:"title"`
-	Username         string `json:"username"`
-	Password         string `json:"password"`
-	ContestShortName string `json:"contest_short_name"`
-	FromName         string `json:"from_name"`
+	ContestUrl       string    `json:"contest_url"`
+	Deadline         string    `json:"deadline"`
+	FirstName        string    `json:"first_name"`
+	Title            string    `json:"title"`
+	Username         string    `json:"username"`
+	Password         string    `json:"password"`
+	ContestShortName string    `json:"contest_short_name"`
+	FromName         string    `json:"from_name"`
+	Email            string    `json:"email"`
+	StartTime        time.Time `json:"start_time"`
+	EndTime          time.Time `json:"end_time"`
 }
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"embed"
+	"fmt"
+	htmltemplate "html/template"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Pages of the web UI, rendered on the server without any scripts
+//
+//go:embed ui/*.html
+var uiFiles embed.FS
+
+var uiTemplates = htmltemplate.Must(htmltemplate.New("ui").ParseFS(uiFiles, "ui/*.html"))
+
+// Results formats offered for download on the contest page
+var uiResultsFormats = []string{"csv", "tsv", "html", "markdown", "json"}
+
+// Pages of the web UI:
+//
+//	GET  /                                  Contests
+//	GET  /contests/new, POST /contests/new  Create a contest (CREATE_CONTEST job)
+//	GET  /contests/<shortname>              Candidates of a contest, results downloads and recent jobs
+//	POST /contests/<shortname>/users        Upload a users file (ADD_USERS job)
+//	POST /contests/<shortname>/resend       Resend credentials of the selected candidates (RESEND_EMAIL_USERS job)
+//	POST /contests/<shortname>/delete       Confirm, then delete the selected candidates (DELETE_USERS job)
+//	GET  /contests/<shortname>/results.<f>  Download results in format f
+//	GET  /jobs, /jobs/<id>                  Jobs, result of every users file line of a job
+func (s *Server) registerUi(mux *http.ServeMux) {
+	mux.HandleFunc("/", s.uiContests)
+	mux.HandleFunc("/contests/new", s.uiNewContest)
+	mux.HandleFunc("/contests/", s.uiContest)
+	mux.HandleFunc("/jobs", s.uiJobs)
+	mux.HandleFunc("/jobs/", s.uiJob)
+}
+
+func (s *Server) uiContests(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		s.renderUiError(w, http.StatusNotFound, fmt.Sprintf("Page %s not found", r.URL.Path))
+		return
+	}
+	contests, err := GetContests(s.config)
+	if err != nil {
+		s.renderUiError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	s.renderUi(w, http.StatusOK, "contests.html", map[string]interface{}{"Title": "Contests", "Contests": contests})
+}
+
+func (s *Server) uiNewContest(w http.ResponseWriter, r *http.Request) {
+	data := map[string]interface{}{"Title": "New contest", "Timezone": s.config.CliArgs.Timezone, "Form": url.Values{}}
+	if r.Method == http.MethodPost {
+		if !s.uiSameOrigin(w, r) {
+			return
+		}
+		r.ParseForm()
+		durationHours, _ := strconv.Atoi(r.PostFormValue("contest-duration-hours"))
+		req := &ApiRequest{
+			ContestName:          r.PostFormValue("contest-name"),
+			ContestShortName:     strings.TrimSpace(r.PostFormValue("contest-short-name")),
+			ContestDurationHours: durationHours,
+			Problems:             r.PostFormValue("problems"),
+			StartTime:            r.PostFormValue("start-time"),
+			FreezeBeforeEnd:      r.PostFormValue("freeze-before-end"),
+			Timezone:             r.PostFormValue("timezone"),
+			Operator:             uiOperator(r),
+		}
+		job, err := s.NewJob("CREATE_CONTEST", req)
+		if err == nil {
+			http.Redirect(w, r, fmt.Sprintf("/jobs/%d", job.Id), http.StatusSeeOther)
+			return
+		}
+		data["Error"], data["Form"] = strings.TrimSpace(err.Error()), r.PostForm
+		s.renderUi(w, http.StatusBadRequest, "contest_new.html", data)
+		return
+	}
+	s.renderUi(w, http.StatusOK, "contest_new.html", data)
+}
+
+func (s *Server) uiContest(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/contests/"), "/", 2)
+	contestShortName, page := parts[0], ""
+	if len(parts) == 2 {
+		page = parts[1]
+	}
+	if strings.HasPrefix(page, "results.") && r.Method == http.MethodGet {
+		s.writeResults(w, contestShortName, strings.TrimPrefix(page, "results."))
+		return
+	}
+	contest, err := GetContestByShortName(contestShortName, s.config)
+	if err != nil {
+		s.renderUiError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if contest.Cid == 0 {
+		s.renderUiError(w, http.StatusNotFound, fmt.Sprintf("Contest %s not found", contestShortName))
+		return
+	}
+	if page == "" && r.Method == http.MethodGet {
+		s.renderContest(w, http.StatusOK, contest, "")
+		return
+	}
+	if r.Method != http.MethodPost || !s.uiSameOrigin(w, r) {
+		if r.Method != http.MethodPost {
+			s.renderUiError(w, http.StatusNotFound, fmt.Sprintf("Page %s not found", r.URL.Path))
+		}
+		return
+	}
+
+	r.ParseForm()
+	req := &ApiRequest{ContestShortName: contestShortName, Operator: uiOperator(r)}
+	var op string
+	switch page {
+	case "users":
+		op = "ADD_USERS"
+		if req.Users, err = uiUploadedUsers(r); err != nil {
+			s.renderContest(w, http.StatusBadRequest, contest, strings.TrimSpace(err.Error()))
+			return
+		}
+		req.Category = r.PostFormValue("category")
+		req.AffiliationShortName = r.PostFormValue("affiliation-short-name")
+	case "resend", "delete":
+		op = map[string]string{"resend": "RESEND_EMAIL_USERS", "delete": "DELETE_USERS"}[page]
+		for _, email := range r.PostForm["email"] {
+			req.Users = append(req.Users, UserEntry{Email: email})
+		}
+		if len(req.Users) == 0 {
+			s.renderContest(w, http.StatusBadRequest, contest, "Select at least one candidate")
+			return
+		}
+		if page == "delete" && r.PostFormValue("confirm") != "yes" {
+			s.renderUi(w, http.StatusOK, "contest_delete.html", map[string]interface{}{
+				"Title": "Delete candidates", "Contest": contest, "Emails": r.PostForm["email"]})
+			return
+		}
+	default:
+		s.renderUiError(w, http.StatusNotFound, fmt.Sprintf("Page %s not found", r.URL.Path))
+		return
+	}
+	job, err := s.NewJob(op, req)
+	if err != nil {
+		s.renderContest(w, http.StatusBadRequest, contest, strings.TrimSpace(err.Error()))
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/jobs/%d", job.Id), http.StatusSeeOther)
+}
+
+// Render the page of a contest with its candidates and jobs, along with an error of the last form posted
+func (s *Server) renderContest(w http.ResponseWriter, status int, contest Contest, formErr string) {
+	users, err := GetContestUsers(contest.Cid, s.config.Db)
+	if err != nil {
+		s.renderUiError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	var jobs []Job
+	for _, job := range s.ListJobs() {
+		if job.Contest == contest.ShortName {
+			jobs = append(jobs, job)
+		}
+	}
+	s.renderUi(w, status, "contest.html", map[string]interface{}{
+		"Title":          contest.ShortName,
+		"Contest":        contest,
+		"Users":          users,
+		"Jobs":           jobs,
+		"ResultsFormats": uiResultsFormats,
+		"Error":          formErr,
+	})
+}
+
+func (s *Server) uiJobs(w http.ResponseWriter, r *http.Request) {
+	s.renderUi(w, http.StatusOK, "jobs.html", map[string]interface{}{"Title": "Jobs", "Jobs": s.ListJobs()})
+}
+
+// Row of a users job on its page: result of a users file line with the credentials it got
+type uiJobRow struct {
+	Email    string
+	Result   string
+	Failed   bool
+	Username string
+	Password string
+}
+
+func (s *Server) uiJob(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/jobs/"))
+	job, ok := s.GetJob(id)
+	if err != nil || !ok {
+		s.renderUiError(w, http.StatusNotFound, fmt.Sprintf("Job %s not found", strings.TrimPrefix(r.URL.Path, "/jobs/")))
+		return
+	}
+
+	// Lines of the users file the job did not get to (e.g. it failed reading a user) are not attempted
+	var rows []uiJobRow
+	if job.UsersFile != "" && (job.Status == "succeeded" || job.Status == "failed") {
+		results := make(map[string]string)
+		for _, result := range job.Results {
+			results[result.Email] = result.Result
+		}
+		// Passwords are only kept in the user details file
+		details := make(map[string]UserDetails)
+		for _, user := range readUserDetails(job.UsersFile + ".details") {
+			details[user.Email] = user
+		}
+		entries, _ := ReadUsersFile(job.UsersFile)
+		for _, entry := range entries {
+			row := uiJobRow{Email: entry.Email, Result: getLastStr("NOT_ATTEMPTED", results[entry.Email]),
+				Username: details[entry.Email].Username, Password: details[entry.Email].Password}
+			row.Failed = strings.Contains(row.Result, "FAILED") || row.Result == "NOT_FOUND" || row.Result == "NOT_IN_CONTEST" || row.Result == "NOT_ATTEMPTED"
+			rows = append(rows, row)
+		}
+	}
+	s.renderUi(w, http.StatusOK, "job.html", map[string]interface{}{
+		"Title":   fmt.Sprintf("Job %d", job.Id),
+		"Job":     job,
+		"Rows":    rows,
+		"Running": job.Status == "queued" || job.Status == "running",
+	})
+}
+
+// Users of the users file uploaded with a form, a tsv/csv file like users-file
+func uiUploadedUsers(r *http.Request) (users []UserEntry, err error) {
+	if err = r.ParseMultipartForm(maxRequestBytes); err != nil {
+		return nil, PrintErr("USERS_UPLOAD_ERR", fmt.Sprintf("%v", err))
+	}
+	file, header, err := r.FormFile("users-file")
+	if err != nil {
+		return nil, PrintErr("USERS_UPLOAD_ERR", "choose a users file to upload")
+	}
+	defer file.Close()
+	dat, err := ioutil.ReadAll(file)
+	if err != nil {
+		return nil, PrintErr("USERS_UPLOAD_ERR", fmt.Sprintf("%s: %v", header.Filename, err))
+	}
+	if users, err = ParseUsers(dat, path.Base(header.Filename)); err != nil {
+		return nil, err
+	}
+	if len(users) == 0 {
+		return nil, PrintErr("USERS_FILE_EMPTY", header.Filename)
+	}
+	return users, nil
+}
+
+// Operator of a UI request: the basic auth username, if any
+func uiOperator(r *http.Request) string {
+	username, _, _ := r.BasicAuth()
+	return username
+}
+
+// Refuse forms posted from other sites, browsers send the basic auth credentials of this service along with them
+func (s *Server) uiSameOrigin(w http.ResponseWriter, r *http.Request) bool {
+	origin := getLastStr(r.Referer(), r.Header.Get("Origin"))
+	if origin == "" {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && u.Host == r.Host {
+		return true
+	}
+	log.Printf("UI_CROSS_ORIGIN: refused %s %s from %s\n", r.Method, r.URL.Path, origin)
+	s.renderUiError(w, http.StatusForbidden, "Forms can only be posted from the pages of this service")
+	return false
+}
+
+func (s *Server) renderUiError(w http.ResponseWriter, status int, msg string) {
+	s.renderUi(w, status, "error.html", map[string]interface{}{"Title": "Error", "Error": msg})
+}
+
+func (s *Server) renderUi(w http.ResponseWriter, status int, name string, data map[string]interface{}) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	if err := uiTemplates.ExecuteTemplate(w, name, data); err != nil {
+		log.Printf("UI_RENDER_ERR: %s: %v\n", name, err)
+	}
+}
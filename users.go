@@ -1,19 +1,29 @@
 package main
 
 import (
-	"bufio"
+	"bytes"
+	"encoding/csv"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/go-sql-driver/mysql"
 	"github.com/jinzhu/gorm"
 )
 
-// Create users from tsv file full of emailIDs
-// INPUT: filename of tsv file which has 1 column [Email ID of users]
+// Create users from tsv/csv file full of emailIDs
+// INPUT: filename of tsv/csv file which has either 1 column [Email ID of users] without header or a header row
+// naming its columns (see ReadUsersFile)
 // OUTPUT: filename of tsv file which has 4 columns [Email ID of users, userid, teamid, password]
+// and <filename>.results with the result of every line of the users file [Email ID of users, result]
+// Every line is attempted even if some fail, the op then fails with the number of lines which did
 func PerformOpOnFile(filename string, contestShortName string, op string, config *Config) (err error) {
 	var contests []Contest
 	// Get contest with greatest ID
@@ -24,77 +34,357 @@ func PerformOpOnFile(filename string, contestShortName string, op string, config
 		return PrintErr("CONTEST_NOT_FOUND_ERR", fmt.Sprintf("no contest found for %s", contestShortName))
 	}
 	PrintVal("CONTEST", contests)
-	contestId := contests[0].Cid
 	contestDetails := contests[0]
 
-	file, err := os.Open(filename)
+	entries, err := ReadUsersFile(filename)
 	if err != nil {
-		return PrintErr("FILE_OPEN_ERR", fmt.Sprintf("%v", err))
+		return err
+	}
+	// Workers must never get two lines of one user, both would create it when it is not found
+	entries = DedupeUserEntries(entries)
+	if op == "ADD_USERS" {
+		if err = ResolveUserCategories(entries, config.CliArgs.Category, config.Db); err != nil {
+			return err
+		}
+		if err = ResolveUserAffiliations(entries, config.CliArgs.AffiliationShortName, config.Db); err != nil {
+			return err
+		}
 	}
-	defer file.Close()
 
 	outputFilename := fmt.Sprintf("%s.details", filename)
-	outputFile, err := os.OpenFile(outputFilename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		return PrintErr("FILE_WOPEN_ERR", fmt.Sprintf("%s: %v", outputFilename, err))
+	var outputFile io.Writer
+	if config.Plan != nil {
+		outputFile = config.Plan.FileWriter(outputFilename)
+	} else {
+		// Only the operator may read the passwords of new users
+		file, err := os.OpenFile(outputFilename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return PrintErr("FILE_WOPEN_ERR", fmt.Sprintf("%s: %v", outputFilename, err))
+		}
+		defer file.Close()
+		outputFile = file
 	}
-	defer outputFile.Close()
 	text := fmt.Sprintf("email\tusername\tpassword\tteamid\n")
-	if _, err = outputFile.WriteString(text); err != nil {
+	if _, err = io.WriteString(outputFile, text); err != nil {
 		return PrintErr("USERDETAILS_PRINT_ERR: failed to print user header details: %v\n", fmt.Sprintf("%v", err))
 	}
+	resultsFilename := fmt.Sprintf("%s.results", filename)
+	var resultsFile io.Writer
+	if config.Plan != nil {
+		resultsFile = config.Plan.FileWriter(resultsFilename)
+	} else {
+		file, err := os.OpenFile(resultsFilename, os.O_TRUNC|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return PrintErr("FILE_WOPEN_ERR", fmt.Sprintf("%s: %v", resultsFilename, err))
+		}
+		defer file.Close()
+		resultsFile = file
+	}
+	if _, err = io.WriteString(resultsFile, "email\tresult\n"); err != nil {
+		return PrintErr("USERRESULTS_PRINT_ERR", fmt.Sprintf("failed to print user results header: %v", err))
+	}
 
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := scanner.Text()
-		log.Printf("LINE_READ: (%s) Attempting to create user...\n", line)
-
-		// Get user with email ID, if already present dont create a new one
-		var user *User
-		if strings.HasSuffix(op, "USERS") {
-			user, err = GetUserById("email", line, false, config.Db)
-			if err != nil && !strings.Contains(err.Error(), "USER_NOT_FOUND") {
-				return PrintErr("READ_USER_BY_EMAIL_ERR", fmt.Sprintf("(email %s): %v", line, err))
+	// Users are processed by a pool of workers, user details are written in users file order
+	concurrency := config.CliArgs.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	details := NewOrderedWriter(outputFile)
+	results := NewOrderedWriter(resultsFile)
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	var errMutex sync.Mutex
+	failedRows := 0
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				text, result, opErr := PerformOpOnEntry(entries[i], op, contestDetails, config)
+				details.Write(i, text)
+				results.Write(i, fmt.Sprintf("%s\t%s\n", entries[i].Email, strings.Replace(result, "\n", " ", -1)))
+				errMutex.Lock()
+				if opErr != nil && err == nil {
+					err = opErr
+				}
+				if strings.HasPrefix(result, "FAILED") {
+					failedRows++
+				}
+				errMutex.Unlock()
 			}
+		}()
+	}
+	for i := range entries {
+		errMutex.Lock()
+		failed := err != nil
+		errMutex.Unlock()
+		if failed {
+			break
 		}
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	if err != nil {
+		return err
+	}
 
-		if op == "ADD_USERS" {
-			if user != nil && user.Email != "" && user.UserId > 0 {
-				log.Printf("USER_ALREADY_PRESENT: (%s) user already present, skipping ...\n", line)
-			} else {
-				newUser, err := CreateUser(line, contestId, config)
-				if err == nil {
-					text := fmt.Sprintf("%s\t%s\t%s\t%d\n", newUser.Email, newUser.Username, newUser.ClearPassword, newUser.TeamId)
-					if _, err = outputFile.WriteString(text); err != nil {
-						log.Printf("USERDETAILS_PRINT_ERR: failed to print user details for user (%v): %v\n", text, err)
-					}
-
-					// Send credentials by email
-					SendContestWelcomeEmail(newUser, contestDetails, config)
-				}
+	log.Printf("Finished %s users from file %s for contest %s\n", op, filename, contestShortName)
+	if failedRows > 0 {
+		return PrintErr("USERS_FAILED", fmt.Sprintf("%d of %d rows failed, see %s", failedRows, len(entries), resultsFilename))
+	}
+	return nil
+}
+
+// Perform op on a single users file entry and return its line for the user details file (empty if nothing changed)
+// and its result: CREATED, ADDED_TO_CONTEST, ALREADY_IN_CONTEST, RESENT, DELETED, REMOVED_FROM_CONTEST, NOT_IN_CONTEST,
+// NOT_FOUND or FAILED with the error. Failures to email credentials are appended to the result as EMAIL_FAILED
+// Only errors reading the user abort the whole op, failures to create/update/delete a single user are logged
+func PerformOpOnEntry(entry UserEntry, op string, contestDetails Contest, config *Config) (text string, result string, err error) {
+	line := entry.Email
+	log.Printf("LINE_READ: (%s) Attempting to %s...\n", line, op)
+
+	// Get user with email ID, if already present dont create a new one
+	var user *User
+	if strings.HasSuffix(op, "USERS") {
+		user, err = GetUserById("email", line, false, config.Db)
+		if err != nil && !strings.Contains(err.Error(), "USER_NOT_FOUND") {
+			err = PrintErr("READ_USER_BY_EMAIL_ERR", fmt.Sprintf("(email %s): %v", line, err))
+			return "", failedResult(err), err
+		}
+	}
+
+	var opErr, emailErr error
+	if op == "ADD_USERS" {
+		if user != nil && user.Email != "" && user.UserId > 0 {
+			// Existing users keep their credentials, only their team is registered for this contest
+			added, err := AddUserToContest(user, contestDetails.Cid, config)
+			opErr, result = err, "ALREADY_IN_CONTEST"
+			if err == nil && added {
+				text = fmt.Sprintf("%s\t%s\t%s\t%d\n", user.Email, user.Username, "", user.TeamId)
+				result = "ADDED_TO_CONTEST"
 			}
-		} else if op == "RESEND_EMAIL_USERS" {
-			err = UpdateUserPassword(user, config)
+		} else {
+			newUser, err := CreateUser(entry, contestDetails.Cid, config)
+			opErr, result = err, "CREATED"
 			if err == nil {
-				text := fmt.Sprintf("%s\t%s\t%s\t%d\n", user.Email, user.Username, user.ClearPassword, user.TeamId)
-				if _, err = outputFile.WriteString(text); err != nil {
-					log.Printf("USERDETAILS_PRINT_ERR: failed to print user details for user (%v): %v\n", text, err)
-				}
+				text = fmt.Sprintf("%s\t%s\t%s\t%d\n", newUser.Email, newUser.Username, newUser.ClearPassword, newUser.TeamId)
 				// Send credentials by email
-				SendContestWelcomeEmail(*user, contestDetails, config)
+				emailErr = SendContestWelcomeEmail(newUser, contestDetails, config)
 			}
-		} else if op == "DELETE_USERS" {
-			DeleteUser("email", line, contestId, config)
 		}
+	} else if op == "RESEND_EMAIL_USERS" {
+		if user == nil {
+			log.Printf("USER_NOT_PRESENT: (%s) user not present, skipping ...\n", line)
+			result = "NOT_FOUND"
+		} else if opErr = UpdateUserPassword(user, config); opErr == nil {
+			text = fmt.Sprintf("%s\t%s\t%s\t%d\n", user.Email, user.Username, user.ClearPassword, user.TeamId)
+			result = "RESENT"
+			// Send credentials by email
+			emailErr = SendContestWelcomeEmail(*user, contestDetails, config)
+		}
+	} else if op == "DELETE_USERS" {
+		if user == nil {
+			result = "NOT_FOUND"
+		} else {
+			deleted, err := DeleteUser("email", line, contestDetails.Cid, config)
+			opErr, result = err, "REMOVED_FROM_CONTEST"
+			if deleted {
+				result = "DELETED"
+			}
+			if err != nil && strings.Contains(err.Error(), "NOT_IN_CONTEST") {
+				opErr, result = nil, "NOT_IN_CONTEST"
+			}
+		}
+	}
+	if opErr != nil {
+		return text, failedResult(opErr), nil
 	}
-	if err = scanner.Err(); err != nil {
-		return PrintErr("FILE_READ_ERR", fmt.Sprintf("%v", err))
+	if emailErr != nil {
+		result += ", EMAIL_FAILED: " + strings.TrimSpace(emailErr.Error())
 	}
+	return text, result, nil
+}
 
-	log.Printf("Finished %s users from file %s for contest %s\n", op, filename, contestShortName)
+// Result of a users file entry which failed, with the error code and message
+func failedResult(err error) string {
+	return "FAILED: " + strings.TrimSpace(err.Error())
+}
+
+// Read users from tsv/csv file
+// Files without a header row have 1 column [Email ID of users] (only the first column is used)
+// Files with a header row (a column named "email") may have the following optional columns in any order:
+// name (full name), team (team name), category (categoryid or name), affiliation (affilid or shortname), room
+// Delimiter is comma for .csv files and tab otherwise (comma if the first line has commas but no tabs)
+func ReadUsersFile(filename string) (entries []UserEntry, err error) {
+	dat, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, PrintErr("FILE_OPEN_ERR", fmt.Sprintf("%v", err))
+	}
+	return ParseUsers(dat, filename)
+}
+
+// Parse users from the contents of a tsv/csv users file (see ReadUsersFile), filename only picks the delimiter
+func ParseUsers(dat []byte, filename string) (entries []UserEntry, err error) {
+	firstLine := strings.SplitN(string(dat), "\n", 2)[0]
+	reader := csv.NewReader(bytes.NewReader(dat))
+	reader.Comma = '\t'
+	if strings.HasSuffix(strings.ToLower(filename), ".csv") || (strings.Contains(firstLine, ",") && !strings.Contains(firstLine, "\t")) {
+		reader.Comma = ','
+	}
+	reader.FieldsPerRecord = -1
+	// Fields are trimmed by get, TrimLeadingSpace would also swallow empty fields of tab delimited files
+	reader.LazyQuotes = true
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, PrintErr("FILE_READ_ERR", fmt.Sprintf("%s: %v", filename, err))
+	}
+
+	// Map column names to column indexes, legacy files have only email in first column
+	columns := map[string]int{"email": 0}
+	if len(records) > 0 {
+		header := make(map[string]int)
+		for i, name := range records[0] {
+			name = strings.ToLower(strings.TrimSpace(name))
+			header[strings.NewReplacer(" ", "_", "-", "_").Replace(name)] = i
+		}
+		headerColumns := make(map[string]int)
+		for column, aliases := range usersFileColumns {
+			for _, alias := range aliases {
+				if i, ok := header[alias]; ok {
+					headerColumns[column] = i
+				}
+			}
+		}
+		// First line is a header if it names the email column (by any of its aliases)
+		if _, ok := headerColumns["email"]; ok {
+			columns = headerColumns
+			records = records[1:]
+		}
+	}
+
+	entries = make([]UserEntry, 0, len(records))
+	for _, record := range records {
+		get := func(column string) string {
+			i, ok := columns[column]
+			if !ok || i >= len(record) {
+				return ""
+			}
+			return strings.TrimSpace(record[i])
+		}
+		entry := UserEntry{
+			Email:       get("email"),
+			Name:        get("name"),
+			TeamName:    get("team"),
+			Affiliation: get("affiliation"),
+		}
+		if entry.Email == "" || strings.HasPrefix(entry.Email, "#") {
+			continue
+		}
+		if category := get("category"); category != "" {
+			if categoryId, err := strconv.Atoi(category); err == nil {
+				entry.CategoryId = categoryId
+			} else {
+				entry.Category = category
+			}
+		}
+		if affilId, err := strconv.Atoi(entry.Affiliation); err == nil {
+			entry.AffilId = &affilId
+			entry.Affiliation = ""
+		}
+		if room := get("room"); room != "" {
+			entry.Room = &room
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// Drop users file entries whose email (case insensitive) was already seen on an earlier line, the first line is kept
+func DedupeUserEntries(entries []UserEntry) []UserEntry {
+	seen := make(map[string]bool)
+	unique := make([]UserEntry, 0, len(entries))
+	for _, entry := range entries {
+		email := strings.ToLower(entry.Email)
+		if seen[email] {
+			log.Printf("DUPLICATE_EMAIL: (%s) skipping repeated users file line\n", entry.Email)
+			continue
+		}
+		seen[email] = true
+		unique = append(unique, entry)
+	}
+	return unique
+}
+
+// Set categoryid of users file entries which have a category name, or no category at all
+// (to defaultCategory if given, categoryid or name)
+func ResolveUserCategories(entries []UserEntry, defaultCategory string, db *gorm.DB) (err error) {
+	categoryIds := make(map[string]int)
+	for i := range entries {
+		categoryRef := entries[i].Category
+		if categoryRef == "" && entries[i].CategoryId == 0 {
+			categoryRef = defaultCategory
+		}
+		if categoryRef == "" {
+			continue
+		}
+		if _, ok := categoryIds[categoryRef]; !ok {
+			category, err := GetCategoryByRef(categoryRef, db)
+			if err != nil {
+				return err
+			}
+			categoryIds[categoryRef] = category.CategoryId
+		}
+		entries[i].CategoryId = categoryIds[categoryRef]
+	}
+	return nil
+}
+
+// Set affilid of users file entries which have an affiliation shortname, or no affiliation at all
+// (to defaultAffiliation if given), creating affiliations which are missing
+func ResolveUserAffiliations(entries []UserEntry, defaultAffiliation string, db *gorm.DB) (err error) {
+	affilIds := make(map[string]int)
+	for i := range entries {
+		shortName := entries[i].Affiliation
+		if shortName == "" && entries[i].AffilId == nil {
+			shortName = defaultAffiliation
+		}
+		if shortName == "" {
+			continue
+		}
+		if _, ok := affilIds[shortName]; !ok {
+			affiliation, err := CreateAffiliation(shortName, "", "", db)
+			if err != nil {
+				return err
+			}
+			affilIds[shortName] = affiliation.AffilId
+		}
+		affilId := affilIds[shortName]
+		entries[i].AffilId = &affilId
+	}
 	return nil
 }
 
+// Accepted header names for each users file column
+var usersFileColumns = map[string][]string{
+	"email":       {"email", "email_id", "emailid"},
+	"name":        {"name", "full_name", "fullname"},
+	"team":        {"team", "team_name", "teamname"},
+	"category":    {"category", "categoryid", "category_id"},
+	"affiliation": {"affiliation", "affilid", "affiliation_id"},
+	"room":        {"room"},
+}
+
+// Get users whose team is registered for a contest, ordered by email
+func GetContestUsers(contestId int, db *gorm.DB) (users []User, err error) {
+	err = db.Table("user").Select("user.*").Joins("JOIN contestteam ON contestteam.teamid = user.teamid").
+		Where("contestteam.cid = ?", contestId).Order("user.email").Find(&users).Error
+	if err != nil {
+		return nil, PrintErr("READ_CONTEST_USERS_ERR", fmt.Sprintf("contestid: %d: %v", contestId, err))
+	}
+	return users, nil
+}
+
 // Get user from mysql db by userid
 func GetUserById(field string, value interface{}, isTxn bool, db *gorm.DB) (user *User, err error) {
 	var users []User
@@ -118,43 +408,116 @@ func GetUserById(field string, value interface{}, isTxn bool, db *gorm.DB) (user
 	return user, nil
 }
 
-// Build new user from emailId
-func BuildNewUser(emailId string, newTeamId int) (user User, team Team, err error) {
-	re := regexp.MustCompile(`\@.*`)
-	name := re.ReplaceAllString(emailId, "")
-	clearPassword := RandStringBytesMaskImprSrcUnsafe(10)
-	username := fmt.Sprintf("user%d", newTeamId)
-	hashPassword, err := GetPasswordHash(clearPassword)
+// Build new user from users file entry with a new random password
+// Name defaults to the part of email before @, team name to the username and category to 3 (Participants)
+func BuildNewUser(entry UserEntry, newTeamId int, username string) (user User, team Team, err error) {
+	clearPassword, hashPassword, err := NewPassword()
 	if err != nil {
 		return user, team, err
 	}
+	user, team = BuildUserTeam(entry, newTeamId, username, clearPassword, hashPassword)
+	return user, team, nil
+}
+
+// Build user and team rows of users file entry for teamid, username and password
+// (userid is left 0 to be allocated by mysql)
+func BuildUserTeam(entry UserEntry, newTeamId int, username string, clearPassword string, hashPassword string) (user User, team Team) {
+	re := regexp.MustCompile(`\@.*`)
+	name := re.ReplaceAllString(entry.Email, "")
+	if entry.Name != "" {
+		name = entry.Name
+	}
 	user = User{
-		UserId:        newTeamId,
 		Username:      username,
 		Name:          name,
-		Email:         emailId,
+		Email:         entry.Email,
 		ClearPassword: clearPassword,
 		HashPassword:  hashPassword,
 		Enabled:       1,
 		TeamId:        newTeamId,
 	}
+	members := username
+	if entry.Name != "" {
+		members = entry.Name
+	}
+	teamName := username
+	if entry.TeamName != "" {
+		teamName = entry.TeamName
+	}
+	categoryId := 3
+	if entry.CategoryId != 0 {
+		categoryId = entry.CategoryId
+	}
 	team = Team{
 		TeamId:     newTeamId,
-		Name:       username,
-		CategoryId: 3,
+		Name:       teamName,
+		CategoryId: categoryId,
+		AffilId:    entry.AffilId,
 		Enabled:    1,
-		Members:    username,
+		Members:    members,
+		Room:       entry.Room,
 		Penalty:    0,
 	}
-	return user, team, nil
+	return user, team
+}
+
+var usernameSlugRe = regexp.MustCompile(`[^a-z0-9]+`)
+
+// Generate a username which is not taken yet for users file entry according to scheme
+// prefix: prefix followed by teamid (e.g. user42), email: slug of the part of email before @ (e.g. jane-doe),
+// random: prefix followed by 6 random letters/digits (e.g. user-k3x9qa)
+// A counter is appended (e.g. jane-doe2) if the username is already taken, candidates are tried from firstAttempt on
+// and the attempt which gave username is returned (CreateUser continues after it if the insert still collides)
+func GenerateUsername(scheme string, prefix string, entry UserEntry, teamId int, firstAttempt int, db *gorm.DB) (username string, attempt int, err error) {
+	for attempt = firstAttempt; attempt <= maxUsernameAttempts; attempt++ {
+		switch scheme {
+		case "email":
+			username = strings.Trim(usernameSlugRe.ReplaceAllString(strings.ToLower(strings.SplitN(entry.Email, "@", 2)[0]), "-"), "-")
+			if username == "" {
+				username = prefix
+			}
+		case "random":
+			username = fmt.Sprintf("%s-%s", prefix, RandHandle(6))
+		default:
+			username = fmt.Sprintf("%s%d", prefix, teamId)
+		}
+		if attempt > 1 && scheme != "random" {
+			username = fmt.Sprintf("%s%d", username, attempt)
+		}
+		var count int
+		if err = db.Table("user").Where("username = ?", username).Count(&count).Error; err != nil {
+			return "", attempt, PrintErr("READ_USERNAME_ERR", fmt.Sprintf("(username %s): %v", username, err))
+		}
+		if count == 0 {
+			return username, attempt, nil
+		}
+	}
+	return "", attempt, PrintErr("USERNAME_TAKEN_ERR", fmt.Sprintf("no free username for %s (scheme %s)", entry.Email, scheme))
+}
+
+// Number of candidate usernames tried for a users file entry
+const maxUsernameAttempts = 100
+
+// Is err mysql's duplicate entry error (a unique key like user.username is already taken)
+func isDuplicateKeyErr(err error) bool {
+	mysqlErr, ok := err.(*mysql.MySQLError)
+	return ok && mysqlErr.Number == 1062
 }
 
 // Create a new user in DOMJudge
-// 1. Creates a new team in team table (TeamId (teamid column) is set by reading the latest team from team table and incrementing it by 1)
-// 2. Creates a new user in user table (UserId (userid column) is set by reading the latest user from user table and incrementing it by 1)
+// 0. Builds user/team and hashes password before starting the txn
+// 1. Creates a new team in team table (TeamId (teamid column) is allocated by mysql AUTO_INCREMENT and read back,
+//    so that concurrent creates by several processes or DOMJudge UI never share a teamid)
+// 2. Creates a new user in user table (UserId (userid column) is allocated by mysql AUTO_INCREMENT independent of
+//    teamid, username is generated by username-scheme and the next candidate is tried if a concurrent create took it)
 // 3. Inserts user into userrole table
 // 4. Adds contest to the user team
-func CreateUser(emailId string, contestId int, config *Config) (newUser User, err error) {
+func CreateUser(entry UserEntry, contestId int, config *Config) (newUser User, err error) {
+	newUser, newTeam, err := BuildNewUser(entry, 0, "")
+	if err != nil {
+		return newUser, PrintErr("HASH_PASSWORD_ERR", fmt.Sprintf("%v", err))
+	}
+
 	tx := config.Db.Begin()
 	defer func() {
 		if r := recover(); r != nil {
@@ -165,42 +528,37 @@ func CreateUser(emailId string, contestId int, config *Config) (newUser User, er
 		return newUser, PrintErr("TXN_OBJ_ERR", fmt.Sprintf("%v", err))
 	}
 
-	// 1. Insert new team
-	var teams []Team
-	// Get team with greatest ID
-	if err = tx.Table("team").Limit(1).Order("teamid desc").Find(&teams).Error; err != nil {
-		tx.Rollback()
-		return newUser, PrintErr("READ_LATEST_TEAM_ERR", fmt.Sprintf("%v", err))
-	}
-	newTeamId := 0
-	if len(teams) == 0 {
-		newTeamId = 1
-	}
-	newTeamId = teams[0].TeamId + 1
-	newUser, newTeam, err := BuildNewUser(emailId, newTeamId)
-	if err != nil {
-		tx.Rollback()
-		return newUser, PrintErr("HASH_PASSWORD_ERR", fmt.Sprintf("%v", err))
-	}
-	PrintVal("LATEST_TEAM", teams)
-	PrintVal("NEW_TEAM", newTeam)
-	if err = tx.Table("team").Create(newTeam).Error; err != nil {
+	// 1. Insert new team, its name and members are set from the generated username in step 2
+	if err = tx.Table("team").Create(&newTeam).Error; err != nil {
 		tx.Rollback()
 		return newUser, PrintErr("INSERT_TEAM_TABLE_ERR", fmt.Sprintf("Error inserting %s into 'team' table: %v", newTeam.Name, err))
 	}
-
-	// 2. Insert new user
-	var users []User
-	// Get user with greatest ID
-	if err = tx.Table("user").Limit(1).Order("userid desc").Find(&users).Error; err != nil {
-		tx.Rollback()
-		return newUser, PrintErr("READ_LATEST_USER_ERR", fmt.Sprintf("%v", err))
-	}
-	PrintVal("LATEST_USER", users)
-	PrintVal("NEW_USER", newUser)
-	if err = tx.Table("user").Create(newUser).Error; err != nil {
-		tx.Rollback()
-		return newUser, PrintErr("INSERT_USER_TABLE_ERR", fmt.Sprintf("Error inserting %s into 'user' table: %v", newUser.Email, err))
+	// 2. Insert new user, a concurrent create may take the username between GenerateUsername's check and the insert
+	// (e.g. a@x.com and a@y.com with the email scheme), the insert is then retried with the next candidate
+	clearPassword, hashPassword := newUser.ClearPassword, newUser.HashPassword
+	for attempt := 1; ; attempt++ {
+		var username string
+		username, attempt, err = GenerateUsername(config.CliArgs.UsernameScheme, config.CliArgs.UsernamePrefix, entry, newTeam.TeamId, attempt, tx)
+		if err != nil {
+			tx.Rollback()
+			return newUser, err
+		}
+		newUser, newTeam = BuildUserTeam(entry, newTeam.TeamId, username, clearPassword, hashPassword)
+		PrintVal("NEW_TEAM", newTeam)
+		if err = tx.Table("team").Where("teamid = ?", newTeam.TeamId).Updates(map[string]interface{}{"name": newTeam.Name, "members": newTeam.Members}).Error; err != nil {
+			tx.Rollback()
+			return newUser, PrintErr("UPDATE_TEAM_TABLE_ERR", fmt.Sprintf("Error updating %s in 'team' table: %v", newTeam.Name, err))
+		}
+		PrintVal("NEW_USER", newUser)
+		err = tx.Table("user").Create(&newUser).Error
+		if err == nil {
+			break
+		}
+		if !isDuplicateKeyErr(err) || attempt >= maxUsernameAttempts {
+			tx.Rollback()
+			return newUser, PrintErr("INSERT_USER_TABLE_ERR", fmt.Sprintf("Error inserting %s into 'user' table: %v", newUser.Email, err))
+		}
+		log.Printf("USERNAME_TAKEN: (%s) username %s was taken by a concurrent create, retrying\n", newUser.Email, username)
 	}
 
 	// 3. Insert new userrole
@@ -246,109 +604,200 @@ func CreateUser(emailId string, contestId int, config *Config) (newUser User, er
 	if err = tx.Commit().Error; err != nil {
 		return newUser, PrintErr("TX_COMMIT_ERR", fmt.Sprintf("Error inserting %s into tables as txn: %v", newUser.Email, err))
 	}
+	config.Audit.Record(AuditEntry{Action: "CREATE_USER", Contest: config.CliArgs.ContestShortName, Cid: contestId,
+		TeamIds: []int{newUser.TeamId}, UserIds: []int{newUser.UserId}, Emails: []string{newUser.Email}})
 	return newUser, nil
 }
 
+// Register team of an existing user for a contest, added is false if it is already registered
+func AddUserToContest(user *User, contestId int, config *Config) (added bool, err error) {
+	var count int
+	if err = config.Db.Table("contestteam").Where("cid = ? AND teamid = ?", contestId, user.TeamId).Count(&count).Error; err != nil {
+		return false, PrintErr("READ_CONTESTTEAM_ERR", fmt.Sprintf("email: %s, teamid: %d, contestid: %d): %v", user.Email, user.TeamId, contestId, err))
+	}
+	if count > 0 {
+		log.Printf("USER_ALREADY_PRESENT: (%s) user already registered for contestid %d, skipping ...\n", user.Email, contestId)
+		return false, nil
+	}
+	newContestTeam := ContestTeam{
+		Cid:    contestId,
+		TeamId: user.TeamId,
+	}
+	PrintVal("NEW_CONTESTTEAM", newContestTeam)
+	if err = config.Db.Table("contestteam").Create(newContestTeam).Error; err != nil {
+		return false, PrintErr("INSERT_CONTESTTEAM_TABLE_ERR", fmt.Sprintf("Error inserting %s into 'contestteam' table: %v", user.Email, err))
+	}
+	log.Printf("USER_ADDED_TO_CONTEST: (email: %s, username: %s, teamid: %d, contestid: %d)\n", user.Email, user.Username, user.TeamId, contestId)
+	config.Audit.Record(AuditEntry{Action: "ADD_TO_CONTEST", Contest: config.CliArgs.ContestShortName, Cid: contestId,
+		TeamIds: []int{user.TeamId}, UserIds: []int{user.UserId}, Emails: []string{user.Email}})
+	return true, nil
+}
+
 // Update user's password in database
 func UpdateUserPassword(user *User, config *Config) (err error) {
-	newUser, _, err := BuildNewUser(user.Email, user.TeamId)
+	clearPassword, hashPassword, err := NewPassword()
 	if err != nil {
 		return err
 	}
-	user.ClearPassword = newUser.ClearPassword
-	user.HashPassword = newUser.HashPassword
+	user.ClearPassword = clearPassword
+	user.HashPassword = hashPassword
 	if err = config.Db.Table("user").Model(user).Updates(map[string]interface{}{"password": user.HashPassword}).Error; err != nil {
 		return PrintErr("UPDATE_PASSWORD_ERR", fmt.Sprintf("Error updating %s 'user': %v", user.Email, err))
 	}
+	config.Audit.Record(AuditEntry{Action: "RESET_PASSWORD", Contest: config.CliArgs.ContestShortName,
+		TeamIds: []int{user.TeamId}, UserIds: []int{user.UserId}, Emails: []string{user.Email}})
 	return nil
 }
 
-// Delete a user from DOMJudge
-// 4. Delete contest from user team
-// 3. Delete user from userrole table
-// 2. Delete user in user table
-// 1. Delete team in team table
-func DeleteUser(field string, value interface{}, contestId int, config *Config) (err error) {
+// Remove a user from a contest in its own txn, deleting the user and team when no contests remain
+func DeleteUser(field string, value interface{}, contestId int, config *Config) (deleted bool, err error) {
 	tx := config.Db.Begin()
+	// Rows journaled in a txn which is rolled back were never deleted, they are dropped from the journal
+	rollback := func() {
+		tx.Rollback()
+		config.Journal.Discard(tx)
+	}
 	defer func() {
 		if r := recover(); r != nil {
-			tx.Rollback()
+			rollback()
 		}
 	}()
 	if err = tx.Error; err != nil {
-		return PrintErr("TXN_OBJ_ERR", fmt.Sprintf("%v", err))
+		return false, PrintErr("TXN_OBJ_ERR", fmt.Sprintf("%v", err))
+	}
+	user, deleted, err := DeleteUserInTx(field, value, contestId, make(map[string]int64), tx, config)
+	if err != nil {
+		rollback()
+		return false, err
+	}
+	// Journal is written and flushed before the commit, so nothing can fail once the rows are deleted
+	if err = config.Journal.CommitTx(tx); err != nil {
+		return false, PrintErr("TX_COMMIT_ERR", fmt.Sprintf("Error deleting %s from tables as txn: %v", user.Email, err))
+	}
+	action := "REMOVE_FROM_CONTEST"
+	if deleted {
+		action = "DELETE_USER"
 	}
+	config.Audit.Record(AuditEntry{Action: action, Contest: config.CliArgs.ContestShortName, Cid: contestId,
+		TeamIds: []int{user.TeamId}, UserIds: []int{user.UserId}, Emails: []string{user.Email}})
+	return deleted, nil
+}
 
+// Remove a user from a contest as part of txn tx (caller rolls back on error and commits)
+// The user and team are deleted (deleted is true) only when the team is not registered for any other contest,
+// a user whose team is not registered for the contest is not touched (NOT_IN_CONTEST error)
+// A deleted team's submissions, judgings, balloons, scoreboard caches and clarifications are deleted (and journaled) too,
+// of a team which is only removed from the contest those of this contest
+// Number of rows deleted from each table is added to counts
+// 4. Delete contest from user team
+// 3. Delete user from userrole table
+// 2. Delete user in user table
+// 1. Delete team in team table
+func DeleteUserInTx(field string, value interface{}, contestId int, counts map[string]int64, tx *gorm.DB, config *Config) (user User, deleted bool, err error) {
 	// 0. Read user and team
-	var user User
 	var team Team
 	var users []User
 	// Get user with greatest ID
 	sqlQuery := fmt.Sprintf("%s = ?", field)
 	if err = tx.Table("user").Limit(1).Where(sqlQuery, value).Find(&users).Error; err != nil {
-		tx.Rollback()
-		return PrintErr("READ_USER_BY_EMAIL_ERR", fmt.Sprintf("%s: %s, contestid: %d): %v", field, value, contestId, err))
+		return user, false, PrintErr("READ_USER_BY_EMAIL_ERR", fmt.Sprintf("%s: %s, contestid: %d): %v", field, value, contestId, err))
 	}
 	if len(users) == 0 {
-		tx.Rollback()
-		return PrintErr("NO_USER_TO_DELETE", fmt.Sprintf("%s: %s, contestid: %d): %v", field, value, contestId, err))
+		return user, false, PrintErr("NO_USER_TO_DELETE", fmt.Sprintf("%s: %v, contestid: %d)", field, value, contestId))
 	}
 	user = users[0]
 	PrintVal("USER_TO_DELETE", user)
 	var teams []Team
 	// Get team with greatest ID
 	if err = tx.Table("team").Where("teamid = ?", user.TeamId).Find(&teams).Error; err != nil {
-		tx.Rollback()
-		return PrintErr("READ_TEAM_ERR", fmt.Sprintf("email: %s, contestid: %d): %v", user.Email, contestId, err))
+		return user, false, PrintErr("READ_TEAM_ERR", fmt.Sprintf("email: %s, contestid: %d): %v", user.Email, contestId, err))
+	}
+	if len(teams) == 0 {
+		return user, false, PrintErr("NO_TEAM_TO_DELETE", fmt.Sprintf("email: %s, teamid: %d, contestid: %d)", user.Email, user.TeamId, contestId))
 	}
 	team = teams[0]
 	PrintVal("TEAM_TO_DELETE", team)
 
-	// 4. Delete contest from user team
-	if err = tx.Table("contestteam").Delete(ContestTeam{}, "teamid = ?", team.TeamId).Error; err != nil {
-		tx.Rollback()
-		return PrintErr("DELETE_CONTESTTEAM_ERR", fmt.Sprintf("email: %s, username: %s, teamid: %d, contestid: %d): %v", user.Email, user.Username, user.TeamId, contestId, err))
+	// 4. Delete contest from user team (saving the row to undo journal first)
+	if err = config.Journal.Snapshot(tx, "contestteam", "cid = ? AND teamid = ?", contestId, team.TeamId); err != nil {
+		return user, false, err
+	}
+	res := tx.Table("contestteam").Delete(ContestTeam{}, "cid = ? AND teamid = ?", contestId, team.TeamId)
+	if err = res.Error; err != nil {
+		return user, false, PrintErr("DELETE_CONTESTTEAM_ERR", fmt.Sprintf("email: %s, username: %s, teamid: %d, contestid: %d): %v", user.Email, user.Username, user.TeamId, contestId, err))
+	}
+	if res.RowsAffected == 0 {
+		// Users who were never in this contest are left alone, even if their team is in no other contest
+		return user, false, PrintErr("NOT_IN_CONTEST", fmt.Sprintf("email: %s, username: %s, teamid: %d, contestid: %d)", user.Email, user.Username, user.TeamId, contestId))
 	}
+	counts["contestteam"] += res.RowsAffected
 	log.Printf("DELETE_CONTESTTEAM_SUCCESS: (email: %s, username: %s, teamid: %d, contestid: %d)\n", user.Email, user.Username, user.TeamId, contestId)
 
+	// Keep user and team if the team is still registered for other contests
+	var otherContests int
+	if err = tx.Table("contestteam").Where("teamid = ?", team.TeamId).Count(&otherContests).Error; err != nil {
+		return user, false, PrintErr("READ_CONTESTTEAM_ERR", fmt.Sprintf("email: %s, teamid: %d): %v", user.Email, user.TeamId, err))
+	}
+	if otherContests > 0 {
+		// Submissions, scoreboard caches and clarifications of the team in this contest go with it, or results and
+		// exports (ranked from rankcache) would still list it
+		desc := fmt.Sprintf("email: %s, teamid: %d, contestid: %d", user.Email, team.TeamId, contestId)
+		if err = deleteDataRows(teamDataTables(team.TeamId, contestId), desc, counts, tx, config); err != nil {
+			return user, false, err
+		}
+		log.Printf("USER_IN_OTHER_CONTESTS: (email: %s, username: %s, teamid: %d, contests: %d) removed from contestid %d only\n", user.Email, user.Username, user.TeamId, otherContests, contestId)
+		return user, false, nil
+	}
+
+	// Delete submissions (with their judgings), balloons, scoreboard caches and clarifications of the team before the
+	// team, so that none are removed by DOMJudge's ON DELETE CASCADE without being journaled and counted
+	desc := fmt.Sprintf("email: %s, teamid: %d", user.Email, team.TeamId)
+	if err = deleteDataRows(teamDataTables(team.TeamId, 0), desc, counts, tx, config); err != nil {
+		return user, false, err
+	}
+
+	// Save rows to undo journal before deleting them
+	snapshots := []struct {
+		table string
+		where string
+		value int
+	}{{"team", "teamid = ?", team.TeamId}, {"user", "userid = ?", user.UserId}, {"userrole", "userid = ?", user.UserId}}
+	for _, t := range snapshots {
+		if err = config.Journal.Snapshot(tx, t.table, t.where, t.value); err != nil {
+			return user, false, err
+		}
+	}
+
 	// 3. Delete user from userrole table
-	if err = tx.Table("userrole").Delete(UserRole{}, "userid = ?", user.UserId).Error; err != nil {
-		tx.Rollback()
-		return PrintErr("DELETE_USERROLE_ERR", fmt.Sprintf("email: %s, username: %s, teamid: %d, contestid: %d): %v", user.Email, user.Username, user.TeamId, contestId, err))
+	res = tx.Table("userrole").Delete(UserRole{}, "userid = ?", user.UserId)
+	if err = res.Error; err != nil {
+		return user, false, PrintErr("DELETE_USERROLE_ERR", fmt.Sprintf("email: %s, username: %s, teamid: %d, contestid: %d): %v", user.Email, user.Username, user.TeamId, contestId, err))
 	}
+	counts["userrole"] += res.RowsAffected
 	log.Printf("DELETE_USERROLE_SUCCESS: (email: %s, username: %s, teamid: %d, contestid: %d)\n", user.Email, user.Username, user.TeamId, contestId)
 
 	// 2. Delete user in user table
-	if err = tx.Table("user").Delete(User{}, "userid = ?", user.UserId).Error; err != nil {
-		tx.Rollback()
-		return PrintErr("DELETE_USER_ERR", fmt.Sprintf("email: %s, username: %s, teamid: %d, contestid: %d): %v", user.Email, user.Username, user.TeamId, contestId, err))
+	res = tx.Table("user").Delete(User{}, "userid = ?", user.UserId)
+	if err = res.Error; err != nil {
+		return user, false, PrintErr("DELETE_USER_ERR", fmt.Sprintf("email: %s, username: %s, teamid: %d, contestid: %d): %v", user.Email, user.Username, user.TeamId, contestId, err))
 	}
+	counts["user"] += res.RowsAffected
 	log.Printf("DELETE_USER_SUCCESS: (email: %s, username: %s, teamid: %d, contestid: %d)\n", user.Email, user.Username, user.TeamId, contestId)
 
 	// 1. Delete team in team table
-	if err = tx.Table("team").Delete(User{}, "teamid = ?", user.TeamId).Error; err != nil {
-		tx.Rollback()
-		return PrintErr("DELETE_TEAM_ERR", fmt.Sprintf("email: %s, username: %s, teamid: %d, contestid: %d): %v", user.Email, user.Username, user.TeamId, contestId, err))
+	res = tx.Table("team").Delete(User{}, "teamid = ?", user.TeamId)
+	if err = res.Error; err != nil {
+		return user, false, PrintErr("DELETE_TEAM_ERR", fmt.Sprintf("email: %s, username: %s, teamid: %d, contestid: %d): %v", user.Email, user.Username, user.TeamId, contestId, err))
 	}
+	counts["team"] += res.RowsAffected
 	log.Printf("DELETE_TEAM_SUCCESS: (email: %s, username: %s, teamid: %d, contestid: %d)\n", user.Email, user.Username, user.TeamId, contestId)
-
-	if err = tx.Commit().Error; err != nil {
-		return PrintErr("TX_COMMIT_ERR", fmt.Sprintf("Error deleting %s from tables as txn: %v", user.Email, err))
-	}
-	return nil
+	return user, true, nil
 }
 
-// Send contest welcome email to a user
-func SendContestWelcomeEmail(user User, contestDetails Contest, config *Config) (err error) {
-	to := user.Email
-	toName := user.Name
-	from := config.CliArgs.SendwithusFrom
+// Build contest welcome email to a user, rendering subject and body with local templates if loaded
+func BuildContestWelcomeEmail(user User, contestDetails Contest, config *Config) (msg *EmailMessage, err error) {
+	loc := GetContestLocation(contestDetails, config.Location)
 	fromName := config.CliArgs.SendwithusFromName
-	replyTo := config.CliArgs.SendwithusReplyTo
-	bcc := config.CliArgs.SendwithusCc // comma separated email id's
-	cc := ""                           // comma separated email id's
-	sendwithusApiKey := config.CliArgs.SendwithusApiKey
-	sendwithusTemplateId := config.CliArgs.SendwithusTemplateId
 	templateData := &ContestWelcomeEmail{
 		ContestUrl:       config.CliArgs.ContestUrl,
 		Deadline:         contestDetails.EndTimeString,
@@ -358,7 +807,67 @@ func SendContestWelcomeEmail(user User, contestDetails Contest, config *Config)
 		Password:         user.ClearPassword,
 		ContestShortName: contestDetails.ShortName,
 		FromName:         fromName,
+		Email:            user.Email,
+		StartTime:        time.Unix(int64(contestDetails.StartTime), 0).In(loc),
+		EndTime:          time.Unix(int64(contestDetails.EndTime), 0).In(loc),
+	}
+	msg = &EmailMessage{
+		To:           user.Email,
+		ToName:       user.Name,
+		From:         config.CliArgs.SendwithusFrom,
+		FromName:     fromName,
+		ReplyTo:      config.CliArgs.SendwithusReplyTo,
+		TemplateData: templateData,
+	}
+	if config.CliArgs.SendwithusCc != "" {
+		msg.Bcc = strings.Split(config.CliArgs.SendwithusCc, ",") // comma separated email id's
+	}
+	if config.EmailTemplates != nil {
+		if msg.Subject, msg.TextBody, msg.HtmlBody, err = config.EmailTemplates.Render(templateData); err != nil {
+			return nil, err
+		}
+	}
+	return msg, nil
+}
+
+// Send contest welcome email to a user using the configured email backend
+func SendContestWelcomeEmail(user User, contestDetails Contest, config *Config) (err error) {
+	if config.EmailSender == nil {
+		log.Printf("EMAIL_DISABLED: no email-backend set, not sending credentials to %s\n", user.Email)
+		return nil
+	}
+	msg, err := BuildContestWelcomeEmail(user, contestDetails, config)
+	if err != nil {
+		return err
+	}
+	if err = config.EmailSender.Send(msg); err != nil {
+		log.Printf("WELCOME_EMAIL_ERR: failed to send credentials to %s: %v\n", user.Email, err)
 	}
-	_, err = SendEmailUsingSendwithus(to, toName, from, fromName, replyTo, cc, bcc, sendwithusApiKey, sendwithusTemplateId, templateData)
 	return err
 }
+
+// Print welcome email of the first user in users file to stdout
+// Nothing is written to the database and no email is sent (username and password are placeholders)
+func PreviewContestWelcomeEmail(filename string, contestShortName string, config *Config) (err error) {
+	contest, err := GetContestByShortName(contestShortName, config)
+	if err != nil {
+		return err
+	}
+	if contest.Name == "" || contest.Cid == 0 {
+		return PrintErr("CONTEST_NOT_FOUND_ERR", fmt.Sprintf("no contest found for %s", contestShortName))
+	}
+	entries, err := ReadUsersFile(filename)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return PrintErr("USERS_FILE_EMPTY", filename)
+	}
+	user, _ := BuildUserTeam(entries[0], 0, "user123", "pa$$w0rd", "")
+	msg, err := BuildContestWelcomeEmail(user, contest, config)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("To: %s <%s>\nSubject: %s\n\n--- text ---\n%s\n--- html ---\n%s\n", msg.ToName, msg.To, msg.Subject, msg.TextBody, msg.HtmlBody)
+	return nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseUsers(t *testing.T) {
+	intPtr := func(i int) *int { return &i }
+	strPtr := func(s string) *string { return &s }
+	tests := []struct {
+		name     string
+		filename string
+		dat      string
+		want     []UserEntry
+	}{
+		{
+			name:     "legacy single column",
+			filename: "users.tsv",
+			dat:      "a@x.com\n\n# b@x.com\n  c@x.com  \n",
+			want:     []UserEntry{{Email: "a@x.com"}, {Email: "c@x.com"}},
+		},
+		{
+			name:     "legacy file uses only the first column",
+			filename: "users.tsv",
+			dat:      "a@x.com\tAlice\n",
+			want:     []UserEntry{{Email: "a@x.com"}},
+		},
+		{
+			name:     "header columns in any order",
+			filename: "users.tsv",
+			dat:      "room\tname\temail\tcategory\taffiliation\nR1\tAlice\ta@x.com\t3\tuni\n",
+			want: []UserEntry{
+				{Email: "a@x.com", Name: "Alice", CategoryId: 3, Affiliation: "uni", Room: strPtr("R1")},
+			},
+		},
+		{
+			name:     "header aliases",
+			filename: "users.tsv",
+			dat:      "Email ID\tFull-Name\tTeam Name\tCategory_Id\tAffilID\na@x.com\tAlice\tTeam A\tParticipants\t7\n",
+			want: []UserEntry{
+				{Email: "a@x.com", Name: "Alice", TeamName: "Team A", Category: "Participants", AffilId: intPtr(7)},
+			},
+		},
+		{
+			name:     "emailid alias",
+			filename: "users.tsv",
+			dat:      "emailid\na@x.com\n",
+			want:     []UserEntry{{Email: "a@x.com"}},
+		},
+		{
+			name:     "empty tab separated fields keep their columns",
+			filename: "users.tsv",
+			dat:      "email\tname\tteam\troom\na@x.com\t\tTeam A\tR1\n",
+			want:     []UserEntry{{Email: "a@x.com", TeamName: "Team A", Room: strPtr("R1")}},
+		},
+		{
+			name:     "quoted csv",
+			filename: "users.csv",
+			dat:      "email,name,team\n\"a@x.com\",\"Doe, Alice\",\"The \"\"A\"\" Team\"\n",
+			want:     []UserEntry{{Email: "a@x.com", Name: "Doe, Alice", TeamName: "The \"A\" Team"}},
+		},
+		{
+			name:     "comma delimiter detected without .csv suffix",
+			filename: "users.txt",
+			dat:      "email, name\na@x.com, Alice\n",
+			want:     []UserEntry{{Email: "a@x.com", Name: "Alice"}},
+		},
+		{
+			name:     "short rows",
+			filename: "users.csv",
+			dat:      "email,name,team\na@x.com\nb@x.com,Bob\n",
+			want:     []UserEntry{{Email: "a@x.com"}, {Email: "b@x.com", Name: "Bob"}},
+		},
+		{
+			name:     "empty file",
+			filename: "users.tsv",
+			dat:      "",
+			want:     []UserEntry{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseUsers([]byte(tt.dat), tt.filename)
+			if err != nil {
+				t.Fatalf("ParseUsers error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseUsers = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -4,11 +4,13 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"math/rand"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 	"unsafe"
 
@@ -16,6 +18,7 @@ import (
 )
 
 var src = rand.NewSource(time.Now().UnixNano())
+var srcMutex sync.Mutex // src is not safe for concurrent use
 
 const letterBytes = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ!@#$%^&*-+;()"
 const (
@@ -26,6 +29,8 @@ const (
 
 // Generate random string bytes
 func RandStringBytesMaskImprSrcUnsafe(n int) string {
+	srcMutex.Lock()
+	defer srcMutex.Unlock()
 	b := make([]byte, n)
 	// A src.Int63() generates 63 random bits, enough for letterIdxMax characters!
 	for i, cache, remain := n-1, src.Int63(), letterIdxMax; i >= 0; {
@@ -43,6 +48,25 @@ func RandStringBytesMaskImprSrcUnsafe(n int) string {
 	return *(*string)(unsafe.Pointer(&b))
 }
 
+// Generate random lowercase handle of letters and digits
+func RandHandle(n int) string {
+	const handleBytes = "abcdefghijklmnopqrstuvwxyz0123456789"
+	srcMutex.Lock()
+	defer srcMutex.Unlock()
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = handleBytes[src.Int63()%int64(len(handleBytes))]
+	}
+	return string(b)
+}
+
+// Generate new random password and its hash
+func NewPassword() (clearPassword string, hashPassword string, err error) {
+	clearPassword = RandStringBytesMaskImprSrcUnsafe(10)
+	hashPassword, err = GetPasswordHash(clearPassword)
+	return clearPassword, hashPassword, err
+}
+
 // Get password hash
 func GetPasswordHash(pswd string) (hash string, err error) {
 	res, err := bcrypt.GenerateFromPassword([]byte(pswd), 10)
@@ -144,6 +168,40 @@ func RequestUrl(reqType string, url string, inputData interface{}, userName stri
 	return status, resBody, nil
 }
 
+// Writes lines produced out of order (e.g. by a pool of workers) in the order of their index
+// Lines are flushed as soon as all lines before them are written, empty lines are skipped
+type OrderedWriter struct {
+	w       io.Writer
+	mutex   sync.Mutex
+	next    int
+	pending map[int]string
+}
+
+func NewOrderedWriter(w io.Writer) *OrderedWriter {
+	return &OrderedWriter{w: w, pending: make(map[int]string)}
+}
+
+// Write line with index i (every index from 0 must be written exactly once)
+func (o *OrderedWriter) Write(i int, line string) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.pending[i] = line
+	for {
+		line, ok := o.pending[o.next]
+		if !ok {
+			return
+		}
+		delete(o.pending, o.next)
+		o.next++
+		if line == "" {
+			continue
+		}
+		if _, err := io.WriteString(o.w, line); err != nil {
+			log.Printf("ORDERED_WRITE_ERR: failed to write line (%v): %v\n", line, err)
+		}
+	}
+}
+
 func GetStringKey(m map[string]interface{}, k string) (vstr string, ok bool) {
 	v, ok := m[k]
 	if ok {